@@ -1,10 +1,15 @@
 package broker
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
+	"slices"
 	"time"
 
+	"github.com/vlaner/postal/filter"
 	"github.com/vlaner/postal/schema"
 )
 
@@ -14,8 +19,84 @@ type Message struct {
 	Payload     []byte
 	SentAt      time.Time
 	DeliveredAt time.Time
+	// Attempts is the number of times message was delivered.
+	Attempts int
+	// Reason is why the last delivery attempt failed.
+	Reason string
+	// OriginTopic is the topic a dead-lettered message was published to.
+	OriginTopic string
+	// OriginAttempts is how many times a dead-lettered message was
+	// delivered in its origin topic.
+	OriginAttempts int
+	// DedupKey is optional idempotency key, publishes with a key already
+	// seen within topic dedup window are dropped.
+	DedupKey string
+	// Headers are application metadata passed through to consumers.
+	Headers map[string]string
+	// NotBefore delays delivery of message until the given time.
+	NotBefore time.Time
+	// ExpiresAt is when undelivered message is dropped, zero means never.
+	ExpiresAt time.Time
+	// Priority from 0 to MaxPriority, messages of higher priority are
+	// delivered first.
+	Priority int
+	// Key orders messages: messages with the same key go to the same
+	// consumer of a group, one at a time.
+	Key string
+	// Retain keeps message as the last known state of the topic, delivered
+	// to subscribers joining later. Empty retained message clears it.
+	Retain bool
+	// DeliverySeq numbers deliveries to a consumer channel, set on every
+	// delivery.
+	DeliverySeq uint64
+	// Offset is position of message in a log topic, starting from 1.
+	Offset uint64
+	// Groups are names of groups holding copies of stored message, empty
+	// for groups without a name. They are set on topics with named groups,
+	// so every group gets its copy back after a restart.
+	Groups []string
+
+	// group is name of the group holding this copy
+	group string
+}
+
+const MaxPriority = 9
+
+// newMessageQueue creates queue delivering messages by priority.
+func newMessageQueue() *Queue {
+	return NewPriorityQueue(MaxPriority, func(item any) int {
+		return item.(Message).Priority
+	})
+}
+
+func (m Message) expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt)
 }
 
+var (
+	ErrInvalidOption  = errors.New("invalid option")
+	ErrTopicNotFound  = errors.New("topic not found")
+	ErrInvalidPayload = errors.New("payload does not match topic schema")
+	ErrInvalidTopic   = errors.New("invalid topic name")
+)
+
+const (
+	reasonNack       = "nack"
+	reasonAckTimeout = "ack timeout"
+	reasonRemoved    = "consumer removed"
+	reasonExpired    = "expired"
+)
+
+func generateMessageID() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(bytes), nil
+}
+
+// NewMessage creates message sent now, empty id is generated on publish.
 func NewMessage(id, topic string, payload []byte) Message {
 	return Message{
 		ID:      id,
@@ -25,212 +106,944 @@ func NewMessage(id, topic string, payload []byte) Message {
 	}
 }
 
-type Topic struct {
-	name      string
-	queue     *Queue
-	Consumers []chan Message
-	schema    *schema.NodeSchema
+type SubscribeRequest struct {
+	Topic string
+	// Group is optional consumer group name. Every group receives all
+	// messages of the topic while members of a group share them.
+	Group     string
+	ConsumeCh chan Message
+	// Filter is optional, only messages matching it are delivered.
+	Filter *filter.Filter
+	// Prefetch limits how many unacked messages the subscription holds,
+	// zero means no limit.
+	Prefetch int
+	// From is where a new group of a log topic starts reading.
+	From Position
 }
 
-type SubscribeRequest struct {
+type registerRequest struct {
+	sub   SubscribeRequest
+	errCh chan error
+}
+
+type publishRequest struct {
+	msg     Message
+	replyCh chan publishReply
+}
+
+type publishReply struct {
+	msgID string
+	err   error
+}
+
+// AckRequest acks messages delivered to ConsumeCh by their IDs and,
+// cumulatively, every message delivered to its subscription to Topic with
+// delivery sequence up to UpTo.
+type AckRequest struct {
+	ConsumeCh  chan Message
+	MessageIDs []string
+	// Topic is topic name or pattern of the subscription UpTo refers to.
+	Topic string
+	// UpTo is ignored when zero.
+	UpTo uint64
+}
+
+type NackRequest struct {
+	ConsumeCh chan Message
+	MessageID string
+	// Delay overrides topic retry backoff when greater than zero.
+	Delay time.Duration
+	// Reason is recorded on the message, defaults to "nack".
+	Reason string
+}
+
+// CreditRequest lets subscription of ConsumeCh to Topic hold Credit more
+// unacked messages than its prefetch.
+type CreditRequest struct {
 	Topic     string
 	ConsumeCh chan Message
+	Credit    int
+}
+
+type schemaRequest struct {
+	topic  string
+	schema schema.NodeSchema
+}
+
+type configureRequest struct {
+	topic string
+	opts  map[string]string
+	errCh chan error
 }
 
 type Broker struct {
 	topics *SyncMap[*Topic]
+	// consumers indexes subscriptions of every consumer channel
+	consumers map[chan Message][]*Consumer
+	// patterns are wildcard subscriptions, attached to every matching topic
+	// including ones created later
+	patterns       []SubscribeRequest
+	schemaPatterns map[string]*schema.NodeSchema
+	// sequences count deliveries of every subscription of a consumer
+	// channel by its topic or pattern, they are kept after unsubscribe so
+	// numbers are never reused while the channel is registered
+	sequences map[chan Message]map[string]*uint64
 
-	register  chan SubscribeRequest
-	remove    chan chan Message
-	msgsCh    chan Message
-	msgAckCh  chan string
-	msgNackCh chan string
-	unacked   *SyncMap[*Message]
-	deliverCh chan struct{}
+	register    chan registerRequest
+	unsubscribe chan SubscribeRequest
+	remove      chan chan Message
+	msgsCh      chan publishRequest
+	msgAckCh    chan AckRequest
+	msgNackCh   chan NackRequest
+	creditCh    chan CreditRequest
+	configureCh chan configureRequest
+	schemaCh    chan schemaRequest
+	unackedCh   chan chan []Message
+	topicsCh    chan chan []Topic
+	redriveCh   chan redriveRequest
+	fetchCh     chan fetchRequest
+	deliverCh   chan struct{}
 
 	quitCh chan struct{}
+	doneCh chan struct{}
+
+	storage Storage
+
+	// scheduler runs ack deadlines and delayed redeliveries
+	scheduler *scheduler
+	// deliverTickerDuration is how often delivery is retried in case a
+	// delivery signal was missed
+	deliverTickerDuration time.Duration
+	// sweepInterval is how often expired messages are removed from queues,
+	// logs are cleaned and offsets are committed
+	sweepInterval time.Duration
+}
+
+type Option func(*Broker)
+
+// WithStorage makes the broker persist messages into s and recover
+// unacked messages from it on start.
+func WithStorage(s Storage) Option {
+	return func(b *Broker) {
+		b.storage = s
+	}
+}
 
-	unackedTickerDuration time.Duration
-	unackedTimeout        time.Duration
+// WithSweepInterval sets how often expired messages are removed, log
+// retention and compaction are applied and group offsets are stored.
+func WithSweepInterval(d time.Duration) Option {
+	return func(b *Broker) {
+		b.sweepInterval = d
+	}
 }
 
-func NewBroker() *Broker {
+func NewBroker(opts ...Option) (*Broker, error) {
 	b := &Broker{
-		topics:    NewSyncMap[*Topic](),
-		msgsCh:    make(chan Message),
-		register:  make(chan SubscribeRequest),
-		remove:    make(chan chan Message),
-		msgAckCh:  make(chan string),
-		msgNackCh: make(chan string),
-		unacked:   NewSyncMap[*Message](),
+		topics:      NewSyncMap[*Topic](),
+		consumers:   make(map[chan Message][]*Consumer),
+		msgsCh:      make(chan publishRequest),
+		register:    make(chan registerRequest),
+		unsubscribe: make(chan SubscribeRequest),
+		remove:      make(chan chan Message),
+		msgAckCh:    make(chan AckRequest),
+		msgNackCh:   make(chan NackRequest),
+		creditCh:    make(chan CreditRequest),
+		configureCh: make(chan configureRequest),
+		schemaCh:    make(chan schemaRequest),
+		unackedCh:   make(chan chan []Message),
+		topicsCh:    make(chan chan []Topic),
+		redriveCh:   make(chan redriveRequest),
+		fetchCh:     make(chan fetchRequest),
 		// deliver channel size of 1 because we have single goroutine to handle channel
 		deliverCh:             make(chan struct{}, 1),
 		quitCh:                make(chan struct{}),
-		unackedTickerDuration: 3 * time.Second,
-		unackedTimeout:        5 * time.Second,
+		doneCh:                make(chan struct{}),
+		storage:               NewMemoryStorage(),
+		scheduler:             newScheduler(),
+		schemaPatterns:        make(map[string]*schema.NodeSchema),
+		sequences:             make(map[chan Message]map[string]*uint64),
+		deliverTickerDuration: 3 * time.Second,
+		sweepInterval:         time.Second,
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	if err := b.recover(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// recover requeues every message the storage has not seen acked. Messages
+// which were in flight before a restart are delivered again.
+func (b *Broker) recover() error {
+	msgs, err := b.storage.Load()
+	if err != nil {
+		return fmt.Errorf("broker: load storage: %w", err)
+	}
+
+	// config decides how messages of the topic are recovered
+	for _, msg := range msgs {
+		if suffix, _ := internalSuffix(msg.Topic); suffix == ConfigSuffix {
+			if err := b.recoverConfig(msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, msg := range msgs {
+		suffix, internal := internalSuffix(msg.Topic)
+		switch {
+		case suffix == RetainedSuffix:
+			b.recoverRetained(msg)
+		case suffix == OffsetsSuffix:
+			if err := b.recoverOffset(msg); err != nil {
+				return err
+			}
+		case internal:
+			// config was recovered first
+		case IsInbox(msg.Topic):
+			// reply stored by an earlier version, its requester is gone
+			if err := b.storage.Ack(msg.Topic, msg.ID); err != nil {
+				return fmt.Errorf("broker: drop inbox message %s: %w", msg.ID, err)
+			}
+		default:
+			b.recoverMessage(msg)
+		}
 	}
 
-	return b
+	return nil
+}
+
+// recoverMessage queues stored message again. Named groups get back their
+// own copies, even before their members subscribe again. Copy of groups
+// without a name waits in the topic queue for the next subscriber.
+func (b *Broker) recoverMessage(msg Message) {
+	topic := b.getOrCreateTopic(msg.Topic)
+	if topic.config.Log || msg.NotBefore.After(time.Now()) {
+		b.queueMessage(msg)
+		return
+	}
+
+	if msg.DedupKey != "" {
+		topic.dedup.add(msg.DedupKey, msg.ID, msg.SentAt)
+	}
+	topic.restore(msg)
 }
 
 func (b *Broker) Run() {
-	unackedTicker := time.NewTicker(b.unackedTickerDuration)
-	defer unackedTicker.Stop()
+	defer close(b.doneCh)
+
+	deliverTicker := time.NewTicker(b.deliverTickerDuration)
+	defer deliverTicker.Stop()
+	sweepTicker := time.NewTicker(b.sweepInterval)
+	defer sweepTicker.Stop()
+	defer b.scheduler.stop()
+
+	b.deliverSignal()
 
 	for {
 		select {
-		case sub := <-b.register:
-			b.newRegister(sub)
+		case req := <-b.register:
+			req.errCh <- b.newRegister(req.sub)
+
+		case req := <-b.unsubscribe:
+			b.unsubscribeConsumer(req)
 
 		case subCh := <-b.remove:
-			b.topics.mu.Lock()
-			for _, topic := range b.topics.m {
-				for i, consumerCh := range topic.Consumers {
-					if consumerCh == subCh {
-						topic.Consumers = append(topic.Consumers[:i], topic.Consumers[i+1:]...)
-						break
-					}
-				}
-			}
-			b.topics.mu.Unlock()
+			b.removeConsumer(subCh)
 
-		case msg := <-b.msgsCh:
-			b.queueMessage(msg)
+		case req := <-b.msgsCh:
+			msgID, err := b.publish(req.msg)
+			req.replyCh <- publishReply{msgID: msgID, err: err}
 
 		case <-b.deliverCh:
 			b.deliverMessages()
 
-		case msgID := <-b.msgAckCh:
-			b.ack(msgID)
+		case req := <-b.msgAckCh:
+			b.ack(req)
+
+		case req := <-b.msgNackCh:
+			b.nack(req)
+
+		case req := <-b.creditCh:
+			b.credit(req)
+
+		case req := <-b.configureCh:
+			req.errCh <- b.configure(req.topic, req.opts)
+
+		case req := <-b.schemaCh:
+			if IsWildcard(req.topic) {
+				b.schemaPatterns[req.topic] = &req.schema
+			} else {
+				b.getOrCreateTopic(req.topic).schema = &req.schema
+			}
+
+		case replyCh := <-b.unackedCh:
+			replyCh <- b.unacked()
 
-		case msgID := <-b.msgNackCh:
-			b.nack(msgID)
+		case replyCh := <-b.topicsCh:
+			replyCh <- b.topicList()
 
-		case <-unackedTicker.C:
-			b.checkUnacked()
+		case req := <-b.redriveCh:
+			msgs, err := b.redrive(req.req)
+			req.replyCh <- redriveResult{msgs: msgs, err: err}
+
+		case req := <-b.fetchCh:
+			b.fetch(req)
+
+		case <-b.scheduler.C():
+			b.scheduler.runDue(time.Now())
+
+		case <-deliverTicker.C:
+			// consumers may have freed their channels since last delivery
+			b.deliverSignal()
+
+		case now := <-sweepTicker.C:
+			b.sweepExpired(now)
+			b.cleanLogs(now)
+			b.commitOffsets()
 
 		case <-b.quitCh:
+			b.commitOffsets()
+			for _, consumers := range b.consumers {
+				for _, c := range consumers {
+					c.out.stop()
+				}
+			}
 			return
 		}
 	}
 }
 
-func (b *Broker) Register(req SubscribeRequest) {
-	b.register <- req
+// Register subscribes req.ConsumeCh to topic or pattern. It returns error
+// wrapping filter.ErrInvalidFilter when filter does not type-check against
+// topic schema.
+func (b *Broker) Register(req SubscribeRequest) error {
+	errCh := make(chan error, 1)
+	b.register <- registerRequest{sub: req, errCh: errCh}
+
+	return <-errCh
 }
 
+// Unsubscribe removes subscriptions of req.ConsumeCh to req.Topic in all groups.
+func (b *Broker) Unsubscribe(req SubscribeRequest) {
+	b.unsubscribe <- req
+}
+
+// Remove removes all subscriptions of subCh.
 func (b *Broker) Remove(subCh chan Message) {
 	b.remove <- subCh
 }
 
-func (b *Broker) Publish(msg Message) {
-	b.msgsCh <- msg
+// Publish stores and queues the message and returns its ID, which is
+// generated when msg.ID is empty. If msg.DedupKey was published to the topic
+// within its dedup window, message is dropped and ID of the earlier one is
+// returned. It returns error wrapping ErrInvalidPayload when message does not
+// match topic schema. Message is on disk once Publish returns only with
+// FsyncAlways log policy.
+func (b *Broker) Publish(msg Message) (string, error) {
+	if msg.ID == "" {
+		id, err := generateMessageID()
+		if err != nil {
+			return "", fmt.Errorf("broker: generate message ID: %w", err)
+		}
+		msg.ID = id
+	}
+
+	replyCh := make(chan publishReply, 1)
+	b.msgsCh <- publishRequest{msg: msg, replyCh: replyCh}
+
+	reply := <-replyCh
+	return reply.msgID, reply.err
+}
+
+// Ack marks message delivered to consumeCh as processed.
+func (b *Broker) Ack(consumeCh chan Message, msgID string) {
+	b.AckBatch(AckRequest{ConsumeCh: consumeCh, MessageIDs: []string{msgID}})
+}
+
+// AckBatch marks many messages delivered to req.ConsumeCh as processed at
+// once.
+func (b *Broker) AckBatch(req AckRequest) {
+	b.msgAckCh <- req
+}
+
+// Credit grants more messages to a subscription with prefetch limit.
+func (b *Broker) Credit(req CreditRequest) {
+	b.creditCh <- req
 }
 
-func (b *Broker) Ack(msgID string) {
-	b.msgAckCh <- msgID
+// Nack returns message delivered to req.ConsumeCh back to the queue it came from.
+func (b *Broker) Nack(req NackRequest) {
+	b.msgNackCh <- req
 }
 
-func (b *Broker) Nack(msgID string) {
-	b.msgNackCh <- msgID
+// ConfigureTopic applies textual options to the topic config, creating the
+// topic if needed. Options only affect subscriptions made afterwards.
+func (b *Broker) ConfigureTopic(topicName string, opts map[string]string) error {
+	errCh := make(chan error, 1)
+	b.configureCh <- configureRequest{topic: topicName, opts: opts, errCh: errCh}
+
+	return <-errCh
 }
 
 func (b *Broker) Unacked() []Message {
-	b.unacked.mu.RLock()
-	defer b.unacked.mu.RUnlock()
+	replyCh := make(chan []Message, 1)
+	b.unackedCh <- replyCh
+
+	return <-replyCh
+}
+
+func (b *Broker) Topics() []Topic {
+	replyCh := make(chan []Topic, 1)
+	b.topicsCh <- replyCh
 
-	msgs := make([]Message, len(b.unacked.m))
+	return <-replyCh
+}
 
-	i := 0
-	for _, msg := range b.unacked.m {
-		msgs[i] = *msg
-		i++
+func (b *Broker) unacked() []Message {
+	var msgs []Message
+	for _, consumers := range b.consumers {
+		for _, c := range consumers {
+			for _, msg := range c.inflight {
+				msgs = append(msgs, *msg)
+			}
+		}
 	}
 
 	return msgs
 }
 
-func (b *Broker) Topics() []Topic {
+func (b *Broker) topicList() []Topic {
 	b.topics.mu.RLock()
 	defer b.topics.mu.RUnlock()
 
-	topics := make([]Topic, len(b.topics.m))
-	i := 0
+	topics := make([]Topic, 0, len(b.topics.m))
 	for _, topic := range b.topics.m {
-		topics[i] = *topic
-		i++
+		topics = append(topics, *topic)
 	}
 
 	return topics
 }
 
+func (b *Broker) configure(topicName string, opts map[string]string) error {
+	if err := ValidateTopic(topicName); err != nil {
+		return err
+	}
+	if IsWildcard(topicName) {
+		return fmt.Errorf("broker: %w: can not configure pattern %q", ErrInvalidTopic, topicName)
+	}
+	if isInternalTopic(topicName) {
+		return fmt.Errorf("broker: %w: can not configure %q", ErrInvalidTopic, topicName)
+	}
+	topic := b.getOrCreateTopic(topicName)
+
+	cfg := topic.config
+	if err := cfg.Apply(opts); err != nil {
+		return err
+	}
+	if isInternalTopic(cfg.DeadLetter) {
+		return fmt.Errorf("broker: %w: can not dead-letter to %q", ErrInvalidOption, cfg.DeadLetter)
+	}
+	if cfg.Log != topic.config.Log && (len(topic.refs) > 0 || !topic.queue.Empty() || len(topic.log) > 0) {
+		return fmt.Errorf("broker: %w: can not change log mode of topic %q holding messages", ErrInvalidOption, topicName)
+	}
+	if cfg.Compact.Enabled() && !cfg.Log {
+		return fmt.Errorf("broker: %w: topic %q must be a log to be compacted", ErrInvalidOption, topicName)
+	}
+	if s := b.schemaFor(topicName); s != nil && cfg.Compact.kind == compactField {
+		if _, ok := s.Lookup(cfg.Compact.name); !ok {
+			return fmt.Errorf("broker: %w: compaction field %q is not in schema of topic %q", ErrInvalidOption, cfg.Compact.name, topicName)
+		}
+	}
+	if err := b.storeConfig(topic, opts); err != nil {
+		return err
+	}
+	reindex := cfg.Compact != topic.config.Compact
+	topic.config = cfg
+	if reindex {
+		topic.reindexLog()
+	}
+
+	return nil
+}
+
+// SetSchema makes topic accept only payloads matching schema, creating the
+// topic if needed.
 func (b *Broker) SetSchema(topicName string, schema schema.NodeSchema) {
-	if topic, exists := b.topics.Get(topicName); exists {
-		topic.schema = &schema
+	b.schemaCh <- schemaRequest{topic: topicName, schema: schema}
+}
+
+// expireDelivery redelivers message if consumer has not acked it since
+// deliveredAt.
+func (b *Broker) expireDelivery(c *Consumer, msgID string, deliveredAt time.Time) {
+	msg, ok := c.inflight[msgID]
+	if !ok || !msg.DeliveredAt.Equal(deliveredAt) {
+		return
 	}
+	c.untrack(msgID)
+
+	b.redeliver(c.topic, c.group, *msg, reasonAckTimeout)
+	b.deliverSignal()
 }
 
-func (b *Broker) checkUnacked() {
-	now := time.Now()
-	for _, unackedMsg := range b.unacked.m {
-		if unackedMsg.DeliveredAt.Add(b.unackedTimeout).After(now) {
-			b.unacked.Delete(unackedMsg.ID)
-			b.queueMessage(*unackedMsg)
+// redeliver returns failed message to the group queue after retry backoff
+// or moves it to the dead-letter topic once it runs out of delivery attempts.
+func (b *Broker) redeliver(topic *Topic, g *group, msg Message, reason string) {
+	b.redeliverAfter(topic, g, msg, reason, topic.config.Retry.Delay(msg.Attempts))
+}
+
+func (b *Broker) redeliverAfter(topic *Topic, g *group, msg Message, reason string, delay time.Duration) {
+	msg.Reason = reason
+
+	if topic.config.MaxDeliveries > 0 && msg.Attempts >= topic.config.MaxDeliveries {
+		g.done(msg)
+		b.deadLetter(topic, msg)
+		return
+	}
+
+	// stored record is replaced so attempts survive a restart, logged
+	// messages are shared by all groups and keep their original record
+	if !topic.config.Log && !IsInbox(topic.name) {
+		b.rewrite(topic, msg)
+	}
+
+	if delay <= 0 {
+		g.requeue(msg)
+		return
+	}
+
+	// later messages with the same key wait for this one
+	if msg.Key != "" {
+		g.busyKeys[msg.Key]++
+	}
+
+	b.scheduler.schedule(time.Now().Add(delay), func() {
+		if msg.Key != "" {
+			g.unbusy(msg.Key)
+		}
+
+		if g.closed {
+			b.release(topic, msg)
+			return
 		}
+
+		g.requeue(msg)
+		b.deliverSignal()
+	})
+}
+
+func (b *Broker) deadLetter(topic *Topic, msg Message) {
+	dead := msg
+	dead.Topic = topic.deadLetterTopic()
+	dead.OriginTopic = topic.name
+	dead.OriginAttempts = msg.Attempts
+	dead.Attempts = 0
+	dead.DeliveredAt = time.Time{}
+	dead.ExpiresAt = time.Time{}
+	dead.Retain = false
+	dead.Offset = 0
+
+	// dead-letter copy is stored before the original is acked, a crash in
+	// between leaves message in both topics rather than in none
+	if err := b.store(dead); err != nil {
+		log.Printf("broker: dead-letter message %s: %v", msg.ID, err)
 	}
+	b.release(topic, msg)
 }
 
+// publish validates message against topic schema before storing it and
+// returns ID of the stored message, which differs from msg.ID for duplicates.
+// Rejected message is copied to <topic>.$INVALID if topic routes invalid
+// messages.
+func (b *Broker) publish(msg Message) (string, error) {
+	if err := ValidateTopic(msg.Topic); err != nil {
+		return "", err
+	}
+	if IsWildcard(msg.Topic) {
+		return "", fmt.Errorf("broker: %w: can not publish to pattern %q", ErrInvalidTopic, msg.Topic)
+	}
+	if isInternalTopic(msg.Topic) {
+		return "", fmt.Errorf("broker: %w: can not publish to %q", ErrInvalidTopic, msg.Topic)
+	}
+	if msg.Priority < 0 || msg.Priority > MaxPriority {
+		return "", fmt.Errorf("broker: %w: priority %d out of range 0 to %d", ErrInvalidOption, msg.Priority, MaxPriority)
+	}
+
+	if _, exists := b.topics.Get(msg.Topic); !exists && IsInbox(msg.Topic) {
+		return "", fmt.Errorf("broker: %w: inbox %q has no subscribers", ErrTopicNotFound, msg.Topic)
+	}
+
+	topic := b.getOrCreateTopic(msg.Topic)
+	if msg.Retain && len(msg.Payload) == 0 {
+		b.clearRetained(topic)
+		return msg.ID, nil
+	}
+
+	if msg.DedupKey != "" {
+		topic.dedup.evict(time.Now(), topic.config.DedupWindow, topic.config.DedupMax)
+		if id, ok := topic.dedup.lookup(msg.DedupKey); ok {
+			return id, nil
+		}
+	}
+
+	// redriven message keeps its original sent time, so topic TTL counts
+	// from when it is published again
+	if msg.ExpiresAt.IsZero() && topic.config.TTL > 0 {
+		msg.ExpiresAt = time.Now().Add(topic.config.TTL)
+	}
+
+	// tombstones of compacted topics have no payload to validate
+	tombstone := false
+	if topic.config.Log && topic.config.Compact.Enabled() {
+		if _, ok := topic.config.Compact.key(msg); !ok {
+			return "", fmt.Errorf("broker: %w: message of compacted topic %q has no key", ErrInvalidOption, msg.Topic)
+		}
+		tombstone = len(msg.Payload) == 0
+	}
+
+	if err := validatePayload(b.schemaFor(msg.Topic), msg.Payload); err != nil && !tombstone {
+		if topic.config.RouteInvalid {
+			invalid := msg
+			invalid.Topic = msg.Topic + InvalidSuffix
+			invalid.OriginTopic = msg.Topic
+			invalid.Reason = err.Error()
+			invalid.Retain = false
+			if err := b.store(invalid); err != nil {
+				log.Printf("broker: route invalid message %s: %v", msg.ID, err)
+			}
+		}
+
+		return "", fmt.Errorf("broker: %w: topic %q: %w", ErrInvalidPayload, msg.Topic, err)
+	}
+
+	msg.Offset = 0
+	if topic.config.Log {
+		if !msg.NotBefore.IsZero() || msg.Retain {
+			return "", fmt.Errorf("broker: %w: log topic %q does not support delayed and retained messages", ErrInvalidOption, msg.Topic)
+		}
+		msg.Offset = topic.lastOffset + 1
+	}
+
+	if err := b.store(msg); err != nil {
+		return "", err
+	}
+
+	if msg.Retain {
+		if err := b.retain(topic, msg); err != nil {
+			return "", err
+		}
+	}
+
+	return msg.ID, nil
+}
+
+// store persists message and queues it without schema validation. Inbox
+// messages are not persisted, their requester is gone after a restart.
+func (b *Broker) store(msg Message) error {
+	msg.Groups = b.getOrCreateTopic(msg.Topic).groupNames()
+	if !IsInbox(msg.Topic) {
+		if err := b.storage.Append(msg); err != nil {
+			return fmt.Errorf("broker: append message %s to storage: %w", msg.ID, err)
+		}
+	}
+
+	b.queueMessage(msg)
+
+	return nil
+}
+
+// queueMessage makes message available to consumers, delayed message is
+// queued by scheduler at its NotBefore time.
 func (b *Broker) queueMessage(msg Message) {
 	topic := b.getOrCreateTopic(msg.Topic)
-	topic.queue.Enqueue(msg)
-	if topic.schema != nil {
-		log.Println("PAYLOAD IS ", string(msg.Payload))
+	if msg.DedupKey != "" {
+		topic.dedup.add(msg.DedupKey, msg.ID, msg.SentAt)
+	}
+	if msg.Offset > 0 {
+		topic.appendLog(msg)
+	}
 
-		var data map[string]interface{}
-		if err := json.Unmarshal(msg.Payload, &data); err != nil {
-			log.Println("UNMARSHAL SCHEMA PAYLOAD", err)
-			return
+	if msg.NotBefore.After(time.Now()) {
+		b.scheduler.schedule(msg.NotBefore, func() {
+			b.queueDelayed(msg)
+		})
+		return
+	}
+
+	topic.enqueue(msg)
+	b.deliverSignal()
+}
+
+func (b *Broker) queueDelayed(msg Message) {
+	if _, exists := b.topics.Get(msg.Topic); !exists && IsInbox(msg.Topic) {
+		// inbox was removed while message waited
+		if err := b.storage.Ack(msg.Topic, msg.ID); err != nil {
+			log.Printf("broker: ack message %s in storage: %v", msg.ID, err)
 		}
+		return
+	}
 
-		log.Println("DATA IS ", data)
+	topic := b.getOrCreateTopic(msg.Topic)
+	topic.enqueue(msg)
+	// groups were not known when message was stored
+	if _, ok := topic.holders[msg.ID]; ok {
+		b.rewrite(topic, msg)
+	}
+	b.deliverSignal()
+}
 
-		err := schema.ValidateMap(*topic.schema, data)
-		if err != nil {
-			log.Println("ERROR VALIDATE BYTES", err)
-			return
+// inflight finds consumer of consumeCh which holds unacked msgID.
+func (b *Broker) inflight(consumeCh chan Message, msgID string) (*Consumer, *Message, bool) {
+	for _, c := range b.consumers[consumeCh] {
+		if msg, ok := c.inflight[msgID]; ok {
+			return c, msg, true
 		}
 	}
 
-	b.unacked.Set(msg.ID, &msg)
+	return nil, nil, false
+}
+
+func (b *Broker) ack(req AckRequest) {
+	for _, msgID := range req.MessageIDs {
+		if c, msg, ok := b.inflight(req.ConsumeCh, msgID); ok {
+			c.group.done(*msg)
+			c.untrack(msgID)
+			b.release(c.topic, *msg)
+		}
+	}
+
+	if req.UpTo > 0 {
+		for _, c := range b.consumers[req.ConsumeCh] {
+			if c.subject() != req.Topic {
+				continue
+			}
+
+			for msgID, msg := range c.inflight {
+				if msg.DeliverySeq <= req.UpTo {
+					c.group.done(*msg)
+					c.untrack(msgID)
+					b.release(c.topic, *msg)
+				}
+			}
+		}
+	}
 
 	b.deliverSignal()
 }
 
-func (b *Broker) ack(msgID string) {
-	b.unacked.Delete(msgID)
+func (b *Broker) credit(req CreditRequest) {
+	for _, c := range b.consumers[req.ConsumeCh] {
+		if c.subject() == req.Topic && c.prefetch > 0 {
+			c.credit += req.Credit
+		}
+	}
+
+	b.deliverSignal()
 }
 
-func (b *Broker) nack(msgID string) {
-	msg, ok := b.unacked.Get(msgID)
+func (b *Broker) nack(req NackRequest) {
+	c, msg, ok := b.inflight(req.ConsumeCh, req.MessageID)
 	if !ok {
 		return
 	}
-	b.unacked.Delete(msgID)
+	c.untrack(req.MessageID)
+
+	reason := req.Reason
+	if reason == "" {
+		reason = reasonNack
+	}
+
+	delay := req.Delay
+	if delay <= 0 {
+		delay = c.topic.config.Retry.Delay(msg.Attempts)
+	}
+
+	b.redeliverAfter(c.topic, c.group, *msg, reason, delay)
+
+	b.deliverSignal()
+}
+
+// release drops a copy of the message held by one of topic groups and acks
+// it in storage once no group holds it.
+func (b *Broker) release(topic *Topic, msg Message) {
+	last := topic.release(msg.ID)
+	// messages of log topics stay in storage until retention removes them
+	if topic.config.Log {
+		return
+	}
+
+	if !last {
+		if topic.dropHolder(msg) {
+			b.rewrite(topic, msg)
+		}
+		return
+	}
+
+	if err := b.storage.Ack(topic.name, msg.ID); err != nil {
+		log.Printf("broker: ack message %s in storage: %v", msg.ID, err)
+	}
+}
+
+// rewrite replaces stored record of msg, naming groups which still hold its
+// copies.
+func (b *Broker) rewrite(topic *Topic, msg Message) {
+	msg.Groups = topic.holders[msg.ID]
+	if err := b.storage.Append(msg); err != nil {
+		log.Printf("broker: store message %s: %v", msg.ID, err)
+	}
+}
+
+func (b *Broker) newRegister(sub SubscribeRequest) error {
+	if sub.Filter != nil {
+		if s := b.schemaFor(sub.Topic); s != nil {
+			if err := sub.Filter.Check(*s); err != nil {
+				return fmt.Errorf("broker: topic %q: %w", sub.Topic, err)
+			}
+		}
+	}
+
+	if !IsWildcard(sub.Topic) {
+		topic := b.getOrCreateTopic(sub.Topic)
+		if sub.From != (Position{}) && !topic.config.Log {
+			return fmt.Errorf("broker: %w: topic %q is not a log", ErrInvalidOption, sub.Topic)
+		}
+
+		b.attach(topic, sub)
+		b.deliverSignal()
+		return nil
+	}
+
+	if sub.From != (Position{}) {
+		return fmt.Errorf("broker: %w: start position of pattern %q", ErrInvalidOption, sub.Topic)
+	}
 
-	msgTopic := b.getOrCreateTopic(msg.Topic)
-	msgTopic.queue.Enqueue(*msg)
+	b.patterns = slices.DeleteFunc(b.patterns, func(existing SubscribeRequest) bool {
+		return existing.ConsumeCh == sub.ConsumeCh && existing.Topic == sub.Topic && existing.Group == sub.Group
+	})
+	b.patterns = append(b.patterns, sub)
+
+	b.topics.mu.RLock()
+	for _, topic := range b.topics.m {
+		if matchTopic(sub.Topic, topic.name) {
+			b.attach(topic, sub)
+		}
+	}
+	b.topics.mu.RUnlock()
 
 	b.deliverSignal()
+
+	return nil
 }
 
-func (b *Broker) newRegister(sub SubscribeRequest) {
-	topic := b.getOrCreateTopic(sub.Topic)
-	topic.Consumers = append(topic.Consumers, sub.ConsumeCh)
-	b.topics.Set(sub.Topic, topic)
+// attach subscribes consumer of sub to topic, sub.Topic is either the topic
+// name or a pattern matching it.
+func (b *Broker) attach(topic *Topic, sub SubscribeRequest) {
+	var pattern string
+	if IsWildcard(sub.Topic) {
+		pattern = sub.Topic
+	}
+
+	c := topic.addConsumer(sub.ConsumeCh, sub.Group, pattern, sub.From)
+	c.seq = b.sequence(sub.ConsumeCh, sub.Topic)
+	c.filter = sub.Filter
+	c.setPrefetch(sub.Prefetch)
+	if c.out == nil && !c.pull {
+		c.out = newOutbox(sub.Prefetch, c.ch, b.deliverSignal)
+	}
+	if !containsItem(b.consumers[sub.ConsumeCh], c) {
+		b.consumers[sub.ConsumeCh] = append(b.consumers[sub.ConsumeCh], c)
+	}
+}
+
+// sequence returns delivery counter of subscription of consumeCh to topic
+// or pattern subject.
+func (b *Broker) sequence(consumeCh chan Message, subject string) *uint64 {
+	seqs, ok := b.sequences[consumeCh]
+	if !ok {
+		seqs = make(map[string]*uint64)
+		b.sequences[consumeCh] = seqs
+	}
+
+	seq, ok := seqs[subject]
+	if !ok {
+		seq = new(uint64)
+		seqs[subject] = seq
+	}
+
+	return seq
+}
+
+func (b *Broker) unsubscribeConsumer(req SubscribeRequest) {
+	b.patterns = slices.DeleteFunc(b.patterns, func(sub SubscribeRequest) bool {
+		return sub.ConsumeCh == req.ConsumeCh && sub.Topic == req.Topic
+	})
+
+	var kept []*Consumer
+	for _, c := range b.consumers[req.ConsumeCh] {
+		if c.subject() != req.Topic {
+			kept = append(kept, c)
+			continue
+		}
+
+		b.detach(c)
+	}
+
+	if len(kept) == 0 {
+		delete(b.consumers, req.ConsumeCh)
+	} else {
+		b.consumers[req.ConsumeCh] = kept
+	}
 
 	b.deliverSignal()
 }
 
+func (b *Broker) removeConsumer(consumeCh chan Message) {
+	b.patterns = slices.DeleteFunc(b.patterns, func(sub SubscribeRequest) bool {
+		return sub.ConsumeCh == consumeCh
+	})
+
+	for _, c := range b.consumers[consumeCh] {
+		b.detach(c)
+	}
+	delete(b.consumers, consumeCh)
+	delete(b.sequences, consumeCh)
+
+	b.deliverSignal()
+}
+
+// detach removes consumer from its topic. Unacked messages go back to the
+// consumer group, messages of a private group are dropped with it.
+func (b *Broker) detach(c *Consumer) {
+	if c.fetch != nil {
+		c.completeFetch()
+	}
+	// messages left in outbox are unacked and go back with the rest
+	c.out.stop()
+
+	inflight, dropped := c.topic.removeConsumer(c)
+	for _, msg := range inflight {
+		if c.group.private {
+			b.release(c.topic, msg)
+			continue
+		}
+
+		b.redeliver(c.topic, c.group, msg, reasonRemoved)
+	}
+
+	for _, msg := range dropped {
+		b.release(c.topic, msg)
+	}
+
+	if IsInbox(c.topic.name) {
+		b.dropInbox(c.topic)
+	}
+}
+
 func (b *Broker) deliverSignal() {
 	select {
 	case b.deliverCh <- struct{}{}:
@@ -239,28 +1052,43 @@ func (b *Broker) deliverSignal() {
 }
 
 func (b *Broker) deliverMessages() {
+	now := time.Now()
+	dropped := make(map[*Topic][]Message)
+	var fetched []*Consumer
+
+	b.topics.mu.RLock()
 	for _, t := range b.topics.m {
-		if len(t.Consumers) == 0 {
-			return
+		delivered, msgs := t.deliver(now)
+		if len(msgs) > 0 {
+			dropped[t] = msgs
 		}
 
-		for !t.queue.Empty() {
-			msg, hasMessage := t.queue.Dequeue()
-			if !hasMessage {
-				break
+		for _, d := range delivered {
+			c, msgID, deliveredAt := d.consumer, d.msg.ID, d.msg.DeliveredAt
+			b.scheduler.schedule(deliveredAt.Add(t.config.AckTimeout), func() {
+				b.expireDelivery(c, msgID, deliveredAt)
+			})
+			if c.fetch != nil {
+				fetched = append(fetched, c)
 			}
+		}
+	}
+	b.topics.mu.RUnlock()
 
-			message := msg.(Message)
-			message.DeliveredAt = time.Now()
-			for _, c := range t.Consumers {
-				select {
-				case c <- message:
-					// TODO: ack for many consumers
-					b.unacked.Set(message.ID, &message)
-				default:
-					// TODO: requeue for many consumers
-				}
+	// pending fetch is answered as soon as it got any messages
+	for _, c := range fetched {
+		if c.fetch != nil {
+			c.completeFetch()
+		}
+	}
 
+	// dead-lettering creates topics, so it waits until topics are unlocked
+	for t, msgs := range dropped {
+		for _, msg := range msgs {
+			if msg.expired(now) {
+				b.expire(t, msg)
+			} else {
+				b.release(t, msg)
 			}
 		}
 	}
@@ -271,15 +1099,25 @@ func (b *Broker) getOrCreateTopic(name string) *Topic {
 	if !exists {
 		topic = &Topic{
 			name:      name,
-			queue:     NewQueue(),
-			Consumers: make([]chan Message, 0),
+			queue:     newMessageQueue(),
+			Consumers: make([]*Consumer, 0),
 			schema:    nil,
+			config:    DefaultTopicConfig(),
+			dedup:     newDedupWindow(),
+			refs:      make(map[string]int),
+			holders:   make(map[string][]string),
+			committed: make(map[string]uint64),
 		}
+		b.topics.Set(name, topic)
+		b.attachPatterns(topic)
 	}
 
 	return topic
 }
 
-func (b *Broker) Stop() {
+func (b *Broker) Stop() error {
 	b.quitCh <- struct{}{}
+	<-b.doneCh
+
+	return b.storage.Close()
 }
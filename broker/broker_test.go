@@ -2,10 +2,15 @@ package broker_test
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/vlaner/postal/broker"
+	"github.com/vlaner/postal/filter"
+	"github.com/vlaner/postal/schema"
 )
 
 type testPubSub struct {
@@ -29,6 +34,14 @@ func (ps *testPubSub) subscribe(topic string) {
 	})
 }
 
+func (ps *testPubSub) subscribeGroup(topic, group string) {
+	ps.b.Register(broker.SubscribeRequest{
+		Topic:     topic,
+		Group:     group,
+		ConsumeCh: ps.ch,
+	})
+}
+
 func (ps *testPubSub) publish(msg broker.Message) {
 	ps.b.Publish(msg)
 }
@@ -37,10 +50,19 @@ func (ps *testPubSub) readMessage() broker.Message {
 	return <-ps.ch
 }
 
-func TestSimple(t *testing.T) {
-	b := broker.NewBroker()
+func newTestBroker(t *testing.T, opts ...broker.Option) *broker.Broker {
+	b, err := broker.NewBroker(opts...)
+	if err != nil {
+		t.Fatalf("unexpected new broker error: %v", err)
+	}
 	go b.Run()
 
+	return b
+}
+
+func TestSimple(t *testing.T) {
+	b := newTestBroker(t)
+
 	topic := "test"
 
 	payload := []byte("testpayload")
@@ -64,8 +86,7 @@ func TestSimple(t *testing.T) {
 }
 
 func TestMessageAck(t *testing.T) {
-	b := broker.NewBroker()
-	go b.Run()
+	b := newTestBroker(t)
 
 	topic := "test"
 
@@ -97,7 +118,7 @@ func TestMessageAck(t *testing.T) {
 		t.Errorf("unexpected unacked message ID %s but wanted ID %s", unackedMsg.ID, msg.ID)
 	}
 
-	b.Ack(msg.ID)
+	b.Ack(tc.ch, msg.ID)
 	// TODO: better way to sync
 	runtime.Gosched()
 	unacked = b.Unacked()
@@ -110,8 +131,7 @@ func TestMessageAck(t *testing.T) {
 }
 
 func TestMessageNack(t *testing.T) {
-	b := broker.NewBroker()
-	go b.Run()
+	b := newTestBroker(t)
 
 	topic := "test"
 	payload := []byte("testpayload")
@@ -142,7 +162,7 @@ func TestMessageNack(t *testing.T) {
 		t.Errorf("unexpected unacked message ID %s but wanted ID %s", unackedMsg.ID, msg.ID)
 	}
 
-	b.Nack(msg.ID)
+	b.Nack(broker.NackRequest{ConsumeCh: tc.ch, MessageID: msg.ID})
 	t.Log("nacked", msg.ID)
 
 	// TODO: better way to sync
@@ -163,8 +183,7 @@ func TestMessageNack(t *testing.T) {
 }
 
 func TestUnsubscribe(t *testing.T) {
-	b := broker.NewBroker()
-	go b.Run()
+	b := newTestBroker(t)
 
 	topic := "test"
 
@@ -184,3 +203,1284 @@ func TestUnsubscribe(t *testing.T) {
 	}
 	b.Stop()
 }
+
+func TestRoundRobinDelivery(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+	if err := b.ConfigureTopic(topic, map[string]string{"delivery": "roundrobin"}); err != nil {
+		t.Fatalf("unexpected configure error: %v", err)
+	}
+
+	first := newTestPubSub(t, b)
+	first.subscribe(topic)
+	second := newTestPubSub(t, b)
+	second.subscribe(topic)
+
+	first.publish(broker.NewMessage("1", topic, []byte("1")))
+	first.publish(broker.NewMessage("2", topic, []byte("2")))
+
+	gotFirst := first.readMessage()
+	gotSecond := second.readMessage()
+	if gotFirst.ID == gotSecond.ID {
+		t.Errorf("expected each consumer to get a different message, both got %s", gotFirst.ID)
+	}
+
+	if n := len(b.Unacked()); n != 2 {
+		t.Errorf("got wrong unacked length: expected 2 got %d", n)
+	}
+}
+
+func TestWorkQueueRequeuesOnRemove(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+	if err := b.ConfigureTopic(topic, map[string]string{"delivery": "leastloaded"}); err != nil {
+		t.Fatalf("unexpected configure error: %v", err)
+	}
+
+	first := newTestPubSub(t, b)
+	first.subscribe(topic)
+	first.publish(broker.NewMessage("1", topic, []byte("1")))
+	got := first.readMessage()
+
+	second := newTestPubSub(t, b)
+	second.subscribe(topic)
+	b.Remove(first.ch)
+
+	gotAfterRemove := second.readMessage()
+	if gotAfterRemove.ID != got.ID {
+		t.Errorf("expected removed consumer message %s to be requeued, got %s", got.ID, gotAfterRemove.ID)
+	}
+
+	unacked := b.Unacked()
+	if len(unacked) != 1 || unacked[0].ID != got.ID {
+		t.Errorf("expected only requeued message to be unacked, got %+v", unacked)
+	}
+}
+
+func TestFanoutRequeuesOnRemove(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+	first := newTestPubSub(t, b)
+	first.subscribe(topic)
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		first.publish(broker.NewMessage(id, topic, []byte(id)))
+	}
+	first.readMessage()
+	b.Remove(first.ch)
+
+	// last subscriber leaves unacked and queued messages to the next one
+	second := newTestPubSub(t, b)
+	second.subscribe(topic)
+	for _, want := range []string{"1", "2", "3", "4", "5"} {
+		got := second.readMessage()
+		if got.ID != want {
+			t.Errorf("got wrong requeued message: expected %s got %s", want, got.ID)
+		}
+		b.Ack(second.ch, got.ID)
+	}
+}
+
+func TestConfigureUnknownOption(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	if err := b.ConfigureTopic("test", map[string]string{"delivery": "random"}); err == nil {
+		t.Error("expected error for unknown delivery mode but got nil")
+	}
+
+	if err := b.ConfigureTopic("test", map[string]string{"unknown": "1"}); err == nil {
+		t.Error("expected error for unknown option but got nil")
+	}
+}
+
+func TestConfigurePattern(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	for _, topic := range []string{"orders.*", "orders.>", "orders..new"} {
+		if err := b.ConfigureTopic(topic, map[string]string{"ttl": "1s"}); !errors.Is(err, broker.ErrInvalidTopic) {
+			t.Errorf("expected invalid topic error configuring %q, got %v", topic, err)
+		}
+	}
+}
+
+func TestConsumerGroups(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+
+	firstIndexer := newTestPubSub(t, b)
+	firstIndexer.subscribeGroup(topic, "indexer")
+	secondIndexer := newTestPubSub(t, b)
+	secondIndexer.subscribeGroup(topic, "indexer")
+	auditor := newTestPubSub(t, b)
+	auditor.subscribeGroup(topic, "auditor")
+
+	auditor.publish(broker.NewMessage("1", topic, []byte("1")))
+	auditor.publish(broker.NewMessage("2", topic, []byte("2")))
+
+	gotFirst := firstIndexer.readMessage()
+	gotSecond := secondIndexer.readMessage()
+	if gotFirst.ID == gotSecond.ID {
+		t.Errorf("expected group members to share messages, both got %s", gotFirst.ID)
+	}
+
+	gotAudit := auditor.readMessage()
+	b.Ack(auditor.ch, gotAudit.ID)
+	gotAuditNext := auditor.readMessage()
+	if gotAudit.ID != "1" || gotAuditNext.ID != "2" {
+		t.Errorf("expected auditor group to get every message, got %s and %s", gotAudit.ID, gotAuditNext.ID)
+	}
+
+	groups := b.Topics()[0].Groups()
+	if len(groups) != 2 {
+		t.Errorf("got wrong groups length: expected 2 got %d", len(groups))
+	}
+}
+
+func TestConsumerGroupOutlivesMembers(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+
+	member := newTestPubSub(t, b)
+	member.subscribeGroup(topic, "indexer")
+	b.Unsubscribe(broker.SubscribeRequest{Topic: topic, ConsumeCh: member.ch})
+
+	member.publish(broker.NewMessage("1", topic, []byte("1")))
+
+	replica := newTestPubSub(t, b)
+	replica.subscribeGroup(topic, "indexer")
+
+	got := replica.readMessage()
+	if got.ID != "1" {
+		t.Errorf("expected message published while group was empty, got %s", got.ID)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+	if err := b.ConfigureTopic(topic, map[string]string{"maxdeliveries": "2"}); err != nil {
+		t.Fatalf("unexpected configure error: %v", err)
+	}
+
+	dead := newTestPubSub(t, b)
+	dead.subscribe(topic + broker.DeadLetterSuffix)
+
+	tc := newTestPubSub(t, b)
+	tc.subscribe(topic)
+	tc.publish(broker.NewMessage("test", topic, []byte("testpayload")))
+
+	for i := 0; i < 2; i++ {
+		got := tc.readMessage()
+		if got.Attempts != i+1 {
+			t.Errorf("got wrong attempts: expected %d got %d", i+1, got.Attempts)
+		}
+		b.Nack(broker.NackRequest{ConsumeCh: tc.ch, MessageID: got.ID})
+	}
+
+	got := dead.readMessage()
+	if got.ID != "test" || got.OriginTopic != topic || got.OriginAttempts != 2 || got.Reason != "nack" {
+		t.Errorf("got wrong dead-lettered message %+v", got)
+	}
+
+	for _, msg := range b.Unacked() {
+		if msg.Topic == topic {
+			t.Errorf("expected no unacked message in %s, got %+v", topic, msg)
+		}
+	}
+}
+
+func TestRedrive(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+	deadTopic := topic + broker.DeadLetterSuffix
+	if err := b.ConfigureTopic(topic, map[string]string{"maxdeliveries": "1"}); err != nil {
+		t.Fatalf("unexpected configure error: %v", err)
+	}
+
+	tc := newTestPubSub(t, b)
+	tc.subscribe(topic)
+	msg := broker.NewMessage("test", topic, []byte("testpayload"))
+	tc.publish(msg)
+	b.Nack(broker.NackRequest{ConsumeCh: tc.ch, MessageID: tc.readMessage().ID})
+
+	listed, err := b.Redrive(broker.RedriveRequest{Topic: deadTopic, DryRun: true})
+	if err != nil {
+		t.Fatalf("unexpected redrive error: %v", err)
+	}
+	if len(listed) != 1 || listed[0].ID != msg.ID {
+		t.Fatalf("expected dry run to list dead-lettered message, got %+v", listed)
+	}
+
+	moved, err := b.Redrive(broker.RedriveRequest{Topic: deadTopic, IDs: []string{"other"}})
+	if err != nil {
+		t.Fatalf("unexpected redrive error: %v", err)
+	}
+	if len(moved) != 0 {
+		t.Errorf("expected ID filter to match nothing, got %+v", moved)
+	}
+
+	moved, err = b.Redrive(broker.RedriveRequest{Topic: deadTopic, IDs: []string{msg.ID}})
+	if err != nil {
+		t.Fatalf("unexpected redrive error: %v", err)
+	}
+	if len(moved) != 1 {
+		t.Fatalf("got wrong moved length: expected 1 got %d", len(moved))
+	}
+
+	got := tc.readMessage()
+	if got.ID != msg.ID || !got.SentAt.Equal(msg.SentAt) || got.Attempts != 1 {
+		t.Errorf("got wrong redriven message %+v", got)
+	}
+
+	listed, _ = b.Redrive(broker.RedriveRequest{Topic: deadTopic, DryRun: true})
+	if len(listed) != 0 {
+		t.Errorf("expected dead-letter topic to be empty after redrive, got %+v", listed)
+	}
+}
+
+func TestRedrivePartial(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+	deadTopic := topic + broker.DeadLetterSuffix
+	if err := b.ConfigureTopic(topic, map[string]string{"maxdeliveries": "1"}); err != nil {
+		t.Fatalf("unexpected configure error: %v", err)
+	}
+
+	tc := newTestPubSub(t, b)
+	tc.subscribe(topic)
+	for _, m := range []struct{ id, payload string }{
+		{id: "1", payload: `{"id": 1}`},
+		{id: "2", payload: `{"id": "x"}`},
+	} {
+		tc.publish(broker.NewMessage(m.id, topic, []byte(m.payload)))
+		b.Nack(broker.NackRequest{ConsumeCh: tc.ch, MessageID: tc.readMessage().ID})
+	}
+
+	// origin schema changed since the messages were dead-lettered
+	p, err := schema.NewParserString(`[ id > int ]`)
+	if err != nil {
+		t.Fatalf("unexpected new parser error: %v", err)
+	}
+	s, err := p.Parse()
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	b.SetSchema(topic, s)
+
+	moved, err := b.Redrive(broker.RedriveRequest{Topic: deadTopic})
+	if !errors.Is(err, broker.ErrInvalidPayload) {
+		t.Errorf("expected invalid payload error, got %v", err)
+	}
+	if len(moved) != 1 || moved[0].ID != "1" {
+		t.Errorf("expected message 1 to be moved before failure, got %+v", moved)
+	}
+
+	// retry does not duplicate message already moved
+	listed, _ := b.Redrive(broker.RedriveRequest{Topic: deadTopic, DryRun: true})
+	if len(listed) != 1 || listed[0].ID != "2" {
+		t.Errorf("expected only message 2 left in dead-letter topic, got %+v", listed)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := broker.RetryPolicy{InitialDelay: time.Second, Multiplier: 2, MaxDelay: 5 * time.Second}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+	for i, want := range expected {
+		if got := policy.Delay(i + 1); got != want {
+			t.Errorf("got wrong delay for attempt %d: expected %v got %v", i+1, want, got)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := policy.Delay(1); got < 500*time.Millisecond || got > 1500*time.Millisecond {
+			t.Fatalf("got delay %v outside of jitter range", got)
+		}
+	}
+}
+
+func TestNackBackoff(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+	if err := b.ConfigureTopic(topic, map[string]string{"retrydelay": "100ms"}); err != nil {
+		t.Fatalf("unexpected configure error: %v", err)
+	}
+
+	tc := newTestPubSub(t, b)
+	tc.subscribe(topic)
+	tc.publish(broker.NewMessage("test", topic, []byte("testpayload")))
+
+	nackedAt := time.Now()
+	b.Nack(broker.NackRequest{ConsumeCh: tc.ch, MessageID: tc.readMessage().ID})
+
+	select {
+	case msg := <-tc.ch:
+		t.Fatalf("expected message to wait for backoff, got %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	got := tc.readMessage()
+	if elapsed := time.Since(nackedAt); elapsed < 100*time.Millisecond {
+		t.Errorf("message redelivered after %v, before backoff", elapsed)
+	}
+	if got.Attempts != 2 || got.Reason != "nack" {
+		t.Errorf("got wrong redelivered message %+v", got)
+	}
+}
+
+func TestAckTimeout(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+	if err := b.ConfigureTopic(topic, map[string]string{"acktimeout": "50ms"}); err != nil {
+		t.Fatalf("unexpected configure error: %v", err)
+	}
+
+	tc := newTestPubSub(t, b)
+	tc.subscribe(topic)
+	tc.publish(broker.NewMessage("test", topic, []byte("testpayload")))
+	tc.readMessage()
+
+	got := tc.readMessage()
+	if got.Attempts != 2 || got.Reason != "ack timeout" {
+		t.Errorf("got wrong redelivered message %+v", got)
+	}
+}
+
+func TestNackDelayAndReason(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+
+	tc := newTestPubSub(t, b)
+	tc.subscribe(topic)
+	tc.publish(broker.NewMessage("test", topic, []byte("testpayload")))
+
+	nackedAt := time.Now()
+	b.Nack(broker.NackRequest{ConsumeCh: tc.ch, MessageID: tc.readMessage().ID, Delay: 50 * time.Millisecond, Reason: "db down"})
+
+	got := tc.readMessage()
+	if elapsed := time.Since(nackedAt); elapsed < 50*time.Millisecond {
+		t.Errorf("message redelivered after %v, before nack delay", elapsed)
+	}
+	if got.Reason != "db down" {
+		t.Errorf("got wrong reason: expected %q got %q", "db down", got.Reason)
+	}
+}
+
+func TestRejectInvalidPayload(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+	p, err := schema.NewParserString(`[ x > int ]`)
+	if err != nil {
+		t.Fatalf("unexpected new parser error: %v", err)
+	}
+	s, err := p.Parse()
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	b.SetSchema(topic, s)
+
+	if err := b.ConfigureTopic(topic, map[string]string{"routeinvalid": "true"}); err != nil {
+		t.Fatalf("unexpected configure error: %v", err)
+	}
+
+	invalid := newTestPubSub(t, b)
+	invalid.subscribe(topic + broker.InvalidSuffix)
+
+	tc := newTestPubSub(t, b)
+	tc.subscribe(topic)
+
+	_, err = b.Publish(broker.NewMessage("bad", topic, []byte(`{"x": "str"}`)))
+	if !errors.Is(err, broker.ErrInvalidPayload) {
+		t.Fatalf("expected invalid payload error, got %v", err)
+	}
+
+	var verr *schema.ValidationError
+	if !errors.As(err, &verr) || verr.Field != "x" {
+		t.Errorf("expected validation error of field x, got %v", err)
+	}
+
+	id, err := b.Publish(broker.NewMessage("", topic, []byte(`{"x": 1}`)))
+	if err != nil {
+		t.Fatalf("unexpected publish error: %v", err)
+	}
+
+	if got := tc.readMessage(); id == "" || got.ID != id {
+		t.Errorf("got wrong message: expected assigned ID %q got %q", id, got.ID)
+	}
+
+	got := invalid.readMessage()
+	if got.ID != "bad" || got.OriginTopic != topic || got.Reason == "" {
+		t.Errorf("got wrong routed invalid message %+v", got)
+	}
+}
+
+func TestPublishDedup(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+	if err := b.ConfigureTopic(topic, map[string]string{"dedupmax": "1"}); err != nil {
+		t.Fatalf("unexpected configure error: %v", err)
+	}
+
+	publish := func(key string) string {
+		msg := broker.NewMessage("", topic, []byte(key))
+		msg.DedupKey = key
+		id, err := b.Publish(msg)
+		if err != nil {
+			t.Fatalf("unexpected publish error: %v", err)
+		}
+
+		return id
+	}
+
+	first := publish("a")
+	if retried := publish("a"); retried != first {
+		t.Errorf("got wrong retried publish ID: expected %s got %s", first, retried)
+	}
+
+	publish("b")
+	if evicted := publish("a"); evicted == first {
+		t.Errorf("expected key evicted above dedup max to be published again")
+	}
+
+	tc := newTestPubSub(t, b)
+	tc.subscribe(topic)
+
+	for _, want := range []string{"a", "b", "a"} {
+		got := tc.readMessage()
+		if string(got.Payload) != want {
+			t.Errorf("got wrong message: expected %s got %s", want, got.Payload)
+		}
+		b.Ack(tc.ch, got.ID)
+	}
+}
+
+func TestInbox(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	inbox, err := broker.NewInbox()
+	if err != nil {
+		t.Fatalf("unexpected new inbox error: %v", err)
+	}
+
+	_, err = b.Publish(broker.NewMessage("", inbox, []byte("reply")))
+	if !errors.Is(err, broker.ErrTopicNotFound) {
+		t.Errorf("expected topic not found error for inbox without subscribers, got %v", err)
+	}
+
+	tc := newTestPubSub(t, b)
+	tc.subscribe(inbox)
+	if _, err := b.Publish(broker.NewMessage("", inbox, []byte("reply"))); err != nil {
+		t.Fatalf("unexpected publish error: %v", err)
+	}
+
+	if got := tc.readMessage(); string(got.Payload) != "reply" {
+		t.Errorf("got wrong reply %q", got.Payload)
+	}
+
+	b.Remove(tc.ch)
+	for _, topic := range b.Topics() {
+		if topic.Name() == inbox {
+			t.Errorf("expected inbox to be removed with its last subscriber")
+		}
+	}
+}
+
+func TestWildcardSubscriptions(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	one := newTestPubSub(t, b)
+	one.subscribe("orders.*")
+
+	all := newTestPubSub(t, b)
+	all.subscribe("orders.>")
+
+	for _, topic := range []string{"orders.eu", "orders.eu.created", "orders.eu.$DLQ", "payments.eu"} {
+		if _, err := b.Publish(broker.NewMessage("", topic, []byte(topic))); err != nil {
+			t.Fatalf("unexpected publish error: %v", err)
+		}
+	}
+
+	got := one.readMessage()
+	if got.Topic != "orders.eu" {
+		t.Errorf("got wrong message for orders.*: %s", got.Topic)
+	}
+	b.Ack(one.ch, got.ID)
+
+	// topics are delivered in no particular order
+	topics := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		got := all.readMessage()
+		topics[got.Topic] = true
+		b.Ack(all.ch, got.ID)
+	}
+	if !topics["orders.eu"] || !topics["orders.eu.created"] {
+		t.Errorf("got wrong messages for orders.>: %v", topics)
+	}
+
+	b.Unsubscribe(broker.SubscribeRequest{Topic: "orders.>", ConsumeCh: all.ch})
+	b.Publish(broker.NewMessage("", "orders.us.created", []byte("late")))
+
+	select {
+	case msg := <-one.ch:
+		t.Errorf("got unexpected message for orders.*: %+v", msg)
+	case msg := <-all.ch:
+		t.Errorf("got message after unsubscribe: %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, err := b.Publish(broker.NewMessage("", "orders.*", nil))
+	if !errors.Is(err, broker.ErrInvalidTopic) {
+		t.Errorf("expected invalid topic error publishing to pattern, got %v", err)
+	}
+}
+
+func TestPatternSchema(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	p, err := schema.NewParserString(`[ id > int ]`)
+	if err != nil {
+		t.Fatalf("unexpected new parser error: %v", err)
+	}
+	s, err := p.Parse()
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	b.SetSchema("orders.>", s)
+
+	_, err = b.Publish(broker.NewMessage("", "orders.eu.created", []byte(`{"id": "x"}`)))
+	if !errors.Is(err, broker.ErrInvalidPayload) {
+		t.Errorf("expected pattern schema to reject payload, got %v", err)
+	}
+
+	if _, err := b.Publish(broker.NewMessage("", "payments.eu", []byte(`{"id": "x"}`))); err != nil {
+		t.Errorf("unexpected publish error on topic outside pattern: %v", err)
+	}
+}
+
+func TestSubscriptionFilter(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "orders"
+	p, err := schema.NewParserString(`[ amount > int region > str ]`)
+	if err != nil {
+		t.Fatalf("unexpected new parser error: %v", err)
+	}
+	s, err := p.Parse()
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	b.SetSchema(topic, s)
+
+	tc := newTestPubSub(t, b)
+	wrong, _ := filter.Parse("amount = 'big'")
+	err = b.Register(broker.SubscribeRequest{Topic: topic, ConsumeCh: tc.ch, Filter: wrong})
+	if !errors.Is(err, filter.ErrInvalidFilter) {
+		t.Fatalf("expected invalid filter error, got %v", err)
+	}
+
+	f, err := filter.Parse("amount > 100 and region in ('eu', 'us')")
+	if err != nil {
+		t.Fatalf("unexpected filter parse error: %v", err)
+	}
+	if err := b.Register(broker.SubscribeRequest{Topic: topic, ConsumeCh: tc.ch, Filter: f}); err != nil {
+		t.Fatalf("unexpected register error: %v", err)
+	}
+
+	for _, payload := range []string{
+		`{"amount": 5, "region": "eu"}`,
+		`{"amount": 500, "region": "asia"}`,
+		`{"amount": 500, "region": "us"}`,
+	} {
+		if _, err := b.Publish(broker.NewMessage("", topic, []byte(payload))); err != nil {
+			t.Fatalf("unexpected publish error: %v", err)
+		}
+	}
+
+	got := tc.readMessage()
+	if string(got.Payload) != `{"amount": 500, "region": "us"}` {
+		t.Errorf("got wrong filtered message %s", got.Payload)
+	}
+	b.Ack(tc.ch, got.ID)
+
+	if unacked := b.Unacked(); len(unacked) != 0 {
+		t.Errorf("expected filtered out messages to be dropped, got %d unacked", len(unacked))
+	}
+}
+
+func TestDelayedDelivery(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+	tc := newTestPubSub(t, b)
+	tc.subscribe(topic)
+
+	delay := 100 * time.Millisecond
+	delayed := broker.NewMessage("delayed", topic, []byte("later"))
+	delayed.NotBefore = time.Now().Add(delay)
+	b.Publish(delayed)
+	b.Publish(broker.NewMessage("now", topic, []byte("now")))
+
+	got := tc.readMessage()
+	if got.ID != "now" {
+		t.Fatalf("got wrong first message: expected now got %s", got.ID)
+	}
+	b.Ack(tc.ch, got.ID)
+
+	got = tc.readMessage()
+	if got.ID != "delayed" || got.DeliveredAt.Before(delayed.NotBefore) {
+		t.Errorf("got delayed message too early: %+v", got)
+	}
+}
+
+func TestMessageTTL(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+	expiring := broker.NewMessage("expiring", topic, []byte("stale"))
+	expiring.ExpiresAt = time.Now().Add(20 * time.Millisecond)
+	b.Publish(expiring)
+	time.Sleep(50 * time.Millisecond)
+
+	tc := newTestPubSub(t, b)
+	tc.subscribe(topic)
+	b.Publish(broker.NewMessage("fresh", topic, []byte("fresh")))
+
+	if got := tc.readMessage(); got.ID != "fresh" {
+		t.Errorf("got wrong message: expected fresh got %s", got.ID)
+	}
+
+	for _, tp := range b.Topics() {
+		if tp.Name() == topic && tp.Expired() != 1 {
+			t.Errorf("got wrong expired count: expected 1 got %d", tp.Expired())
+		}
+	}
+}
+
+func TestTopicTTLFromPublish(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+	if err := b.ConfigureTopic(topic, map[string]string{"ttl": "1m"}); err != nil {
+		t.Fatalf("unexpected configure error: %v", err)
+	}
+
+	// message sent long ago, e.g. redriven one, gets full topic TTL
+	old := broker.NewMessage("old", topic, []byte("old"))
+	old.SentAt = time.Now().Add(-time.Hour)
+	b.Publish(old)
+
+	tc := newTestPubSub(t, b)
+	tc.subscribe(topic)
+	if got := tc.readMessage(); got.ID != "old" || !got.ExpiresAt.After(time.Now()) {
+		t.Errorf("expected old message to be delivered before its TTL, got %+v", got)
+	}
+}
+
+func TestExpiredDeadLetter(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+	if err := b.ConfigureTopic(topic, map[string]string{"ttl": "10ms", "expiry": "deadletter"}); err != nil {
+		t.Fatalf("unexpected configure error: %v", err)
+	}
+
+	dead := newTestPubSub(t, b)
+	dead.subscribe(topic + broker.DeadLetterSuffix)
+
+	// nobody subscribes to topic, so only the sweeper sees the message
+	b.Publish(broker.NewMessage("test", topic, []byte("stale")))
+
+	select {
+	case got := <-dead.ch:
+		if got.ID != "test" || got.OriginTopic != topic || got.Reason != "expired" {
+			t.Errorf("got wrong dead-lettered message %+v", got)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expired message was not dead-lettered")
+	}
+}
+
+func TestPriority(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+	for _, m := range []struct {
+		id       string
+		priority int
+	}{
+		{id: "low1", priority: 0},
+		{id: "high", priority: 9},
+		{id: "low2", priority: 0},
+		{id: "mid", priority: 5},
+	} {
+		msg := broker.NewMessage(m.id, topic, []byte(m.id))
+		msg.Priority = m.priority
+		if _, err := b.Publish(msg); err != nil {
+			t.Fatalf("unexpected publish error: %v", err)
+		}
+	}
+
+	// messages already sent to subscription are not reordered, prefetch
+	// of one keeps the rest in topic queue
+	tc := newTestPubSub(t, b)
+	b.Register(broker.SubscribeRequest{Topic: topic, ConsumeCh: tc.ch, Prefetch: 1})
+
+	// nacked message goes back before messages of lower priority
+	got := tc.readMessage()
+	if got.ID != "high" {
+		t.Fatalf("got wrong first message: expected high got %s", got.ID)
+	}
+	b.Nack(broker.NackRequest{ConsumeCh: tc.ch, MessageID: got.ID})
+
+	for _, want := range []string{"high", "mid", "low1", "low2"} {
+		got := tc.readMessage()
+		if got.ID != want {
+			t.Errorf("got wrong message: expected %s got %s", want, got.ID)
+		}
+		b.Ack(tc.ch, got.ID)
+	}
+
+	bad := broker.NewMessage("", topic, nil)
+	bad.Priority = broker.MaxPriority + 1
+	if _, err := b.Publish(bad); !errors.Is(err, broker.ErrInvalidOption) {
+		t.Errorf("expected invalid option error for priority out of range, got %v", err)
+	}
+}
+
+func TestOrderingKey(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+	if err := b.ConfigureTopic(topic, map[string]string{"delivery": "roundrobin"}); err != nil {
+		t.Fatalf("unexpected configure error: %v", err)
+	}
+
+	first := make(chan broker.Message, 10)
+	second := make(chan broker.Message, 10)
+	for _, ch := range []chan broker.Message{first, second} {
+		if err := b.Register(broker.SubscribeRequest{Topic: topic, ConsumeCh: ch}); err != nil {
+			t.Fatalf("unexpected register error: %v", err)
+		}
+	}
+
+	read := func() (broker.Message, chan broker.Message) {
+		select {
+		case msg := <-first:
+			return msg, first
+		case msg := <-second:
+			return msg, second
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for message")
+			return broker.Message{}, nil
+		}
+	}
+
+	for _, m := range []struct{ id, key string }{
+		{id: "a1", key: "acct-1"},
+		{id: "a2", key: "acct-1"},
+		{id: "b1", key: "acct-2"},
+	} {
+		msg := broker.NewMessage(m.id, topic, []byte(m.id))
+		msg.Key = m.key
+		if _, err := b.Publish(msg); err != nil {
+			t.Fatalf("unexpected publish error: %v", err)
+		}
+	}
+
+	// a2 waits for a1 while b1 of another key is delivered
+	got := make(map[string]chan broker.Message)
+	for range 2 {
+		msg, ch := read()
+		got[msg.ID] = ch
+	}
+	if got["a1"] == nil || got["b1"] == nil {
+		t.Fatalf("expected a1 and b1 to be delivered first, got %v", got)
+	}
+
+	b.Nack(broker.NackRequest{ConsumeCh: got["a1"], MessageID: "a1"})
+	msg, ch := read()
+	if msg.ID != "a1" || ch != got["a1"] {
+		t.Fatalf("expected nacked a1 redelivered to the same consumer, got %s", msg.ID)
+	}
+
+	b.Ack(ch, "a1")
+	msg, ch = read()
+	if msg.ID != "a2" || ch != got["a1"] {
+		t.Errorf("expected a2 delivered to the consumer of a1, got %s", msg.ID)
+	}
+}
+
+func TestOrderingKeyFilter(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "orders"
+	members := make(map[string]*testPubSub)
+	for _, region := range []string{"eu", "us"} {
+		f, err := filter.Parse(fmt.Sprintf("region = '%s'", region))
+		if err != nil {
+			t.Fatalf("unexpected filter parse error: %v", err)
+		}
+
+		tc := newTestPubSub(t, b)
+		if err := b.Register(broker.SubscribeRequest{Topic: topic, Group: "billing", ConsumeCh: tc.ch, Filter: f}); err != nil {
+			t.Fatalf("unexpected register error: %v", err)
+		}
+		members[region] = tc
+	}
+
+	// key of a message goes to a member whose filter matches it
+	for i := range 4 {
+		for _, region := range []string{"eu", "us"} {
+			msg := broker.NewMessage("", topic, []byte(fmt.Sprintf(`{"region": "%s"}`, region)))
+			msg.Key = fmt.Sprintf("%s-%d", region, i)
+			if _, err := b.Publish(msg); err != nil {
+				t.Fatalf("unexpected publish error: %v", err)
+			}
+		}
+	}
+
+	for region, tc := range members {
+		for range 4 {
+			select {
+			case got := <-tc.ch:
+				if got.Key[:2] != region {
+					t.Errorf("got message of key %s in %s member", got.Key, region)
+				}
+				b.Ack(tc.ch, got.ID)
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for %s message", region)
+			}
+		}
+	}
+}
+
+func TestRetained(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "status"
+	for _, payload := range []string{"v1", "v2"} {
+		msg := broker.NewMessage(payload, topic, []byte(payload))
+		msg.Retain = true
+		if _, err := b.Publish(msg); err != nil {
+			t.Fatalf("unexpected publish error: %v", err)
+		}
+	}
+
+	// first subscriber takes over queued v1 and v2 without a duplicate
+	first := newTestPubSub(t, b)
+	first.subscribe(topic)
+	for _, want := range []string{"v1", "v2"} {
+		got := first.readMessage()
+		if got.ID != want {
+			t.Fatalf("got wrong message: expected %s got %s", want, got.ID)
+		}
+		b.Ack(first.ch, got.ID)
+	}
+
+	late := newTestPubSub(t, b)
+	late.subscribe(topic)
+	if got := late.readMessage(); got.ID != "v2" {
+		t.Fatalf("expected late subscriber to get retained v2, got %s", got.ID)
+	}
+	b.Ack(late.ch, "v2")
+
+	// member joining an existing group gets retained message too
+	worker := newTestPubSub(t, b)
+	worker.subscribeGroup(topic, "workers")
+	b.Ack(worker.ch, worker.readMessage().ID)
+
+	joined := newTestPubSub(t, b)
+	joined.subscribeGroup(topic, "workers")
+	if got := joined.readMessage(); got.ID != "v2" {
+		t.Fatalf("expected new group member to get retained v2, got %s", got.ID)
+	}
+	b.Ack(joined.ch, "v2")
+
+	empty := broker.NewMessage("", topic, nil)
+	empty.Retain = true
+	if _, err := b.Publish(empty); err != nil {
+		t.Fatalf("unexpected clear error: %v", err)
+	}
+
+	cleared := newTestPubSub(t, b)
+	cleared.subscribe(topic)
+	select {
+	case msg := <-cleared.ch:
+		t.Errorf("got message after retained was cleared: %+v", msg)
+	case msg := <-first.ch:
+		t.Errorf("got empty retained message delivered: %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestFetch(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "jobs"
+	for _, id := range []string{"1", "2", "3"} {
+		b.Publish(broker.NewMessage(id, topic, []byte(id)))
+	}
+
+	ch := make(chan broker.Message, 1)
+	msgs, err := b.Fetch(broker.FetchRequest{Topic: topic, ConsumeCh: ch, Max: 2})
+	if err != nil {
+		t.Fatalf("unexpected fetch error: %v", err)
+	}
+	if len(msgs) != 2 || msgs[0].ID != "1" || msgs[1].ID != "2" {
+		t.Fatalf("got wrong fetched messages %+v", msgs)
+	}
+	if n := len(b.Unacked()); n != 2 {
+		t.Errorf("got wrong unacked length: expected 2 got %d", n)
+	}
+	for _, msg := range msgs {
+		b.Ack(ch, msg.ID)
+	}
+
+	msgs, _ = b.Fetch(broker.FetchRequest{Topic: topic, ConsumeCh: ch, Max: 10})
+	if len(msgs) != 1 || msgs[0].ID != "3" {
+		t.Fatalf("got wrong rest of messages %+v", msgs)
+	}
+	b.Ack(ch, "3")
+
+	// long poll is answered by message published while it waits
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		b.Publish(broker.NewMessage("4", topic, []byte("4")))
+	}()
+	msgs, _ = b.Fetch(broker.FetchRequest{Topic: topic, ConsumeCh: ch, Max: 10, Wait: time.Second})
+	if len(msgs) != 1 || msgs[0].ID != "4" {
+		t.Fatalf("got wrong long polled messages %+v", msgs)
+	}
+
+	// second fetch of the same consumer fails while the first one waits
+	pending := make(chan []broker.Message, 1)
+	go func() {
+		msgs, _ := b.Fetch(broker.FetchRequest{Topic: topic, ConsumeCh: ch, Max: 10, Wait: time.Second})
+		pending <- msgs
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if _, err := b.Fetch(broker.FetchRequest{Topic: topic, ConsumeCh: ch, Max: 10}); !errors.Is(err, broker.ErrInvalidOption) {
+		t.Errorf("expected invalid option error for second pending fetch, got %v", err)
+	}
+	b.Publish(broker.NewMessage("5", topic, []byte("5")))
+	if msgs := <-pending; len(msgs) != 1 || msgs[0].ID != "5" {
+		t.Fatalf("expected first fetch answered, got %+v", msgs)
+	}
+
+	start := time.Now()
+	msgs, _ = b.Fetch(broker.FetchRequest{Topic: topic, ConsumeCh: ch, Max: 10, Wait: 50 * time.Millisecond})
+	if len(msgs) != 0 || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("expected empty fetch after wait, got %+v", msgs)
+	}
+
+	select {
+	case msg := <-ch:
+		t.Errorf("got fetched message pushed to consumer channel: %+v", msg)
+	default:
+	}
+
+	if _, err := b.Fetch(broker.FetchRequest{Topic: topic, ConsumeCh: ch}); !errors.Is(err, broker.ErrInvalidOption) {
+		t.Errorf("expected invalid option error for zero fetch size, got %v", err)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+	ch := make(chan broker.Message, 10)
+	if err := b.Register(broker.SubscribeRequest{Topic: topic, ConsumeCh: ch, Prefetch: 2}); err != nil {
+		t.Fatalf("unexpected register error: %v", err)
+	}
+	for _, id := range []string{"1", "2", "3", "4"} {
+		b.Publish(broker.NewMessage(id, topic, []byte(id)))
+	}
+
+	read := func(want string) {
+		t.Helper()
+		select {
+		case msg := <-ch:
+			if msg.ID != want {
+				t.Fatalf("got wrong message: expected %s got %s", want, msg.ID)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for message %s", want)
+		}
+	}
+	expectNone := func() {
+		t.Helper()
+		select {
+		case msg := <-ch:
+			t.Fatalf("got message beyond prefetch: %+v", msg)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	read("1")
+	read("2")
+	expectNone()
+
+	b.Ack(ch, "1")
+	read("3")
+	expectNone()
+
+	b.Credit(broker.CreditRequest{Topic: topic, ConsumeCh: ch, Credit: 1})
+	read("4")
+}
+
+func TestPushBacklog(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	// backlog flows as fast as consumer reads, not on deliver ticker
+	for _, prefetch := range []int{10, 0} {
+		topic := fmt.Sprintf("test%d", prefetch)
+		for i := range 5 {
+			b.Publish(broker.NewMessage(fmt.Sprint(i), topic, []byte("data")))
+		}
+
+		tc := newTestPubSub(t, b)
+		b.Register(broker.SubscribeRequest{Topic: topic, ConsumeCh: tc.ch, Prefetch: prefetch})
+
+		deadline := time.After(time.Second)
+		for i := range 5 {
+			select {
+			case msg := <-tc.ch:
+				if msg.ID != fmt.Sprint(i) {
+					t.Fatalf("got wrong message: expected %d got %s", i, msg.ID)
+				}
+			case <-deadline:
+				t.Fatalf("message %d of %s was not delivered before deliver ticker", i, topic)
+			}
+		}
+	}
+}
+
+func TestAckBatch(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "test"
+	ch := make(chan broker.Message, 10)
+	for _, sub := range []string{topic, "other"} {
+		if err := b.Register(broker.SubscribeRequest{Topic: sub, ConsumeCh: ch}); err != nil {
+			t.Fatalf("unexpected register error: %v", err)
+		}
+	}
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		b.Publish(broker.NewMessage(id, topic, []byte(id)))
+	}
+	b.Publish(broker.NewMessage("x", "other", []byte("x")))
+
+	// every subscription numbers its deliveries
+	seqs := make(map[string]uint64)
+	for range 6 {
+		msg := <-ch
+		seqs[msg.ID] = msg.DeliverySeq
+	}
+	if seqs["1"] != 1 || seqs["5"] != 5 || seqs["x"] != 1 {
+		t.Fatalf("got wrong delivery sequences %v", seqs)
+	}
+
+	b.AckBatch(broker.AckRequest{ConsumeCh: ch, MessageIDs: []string{"4", "5"}})
+	if n := len(b.Unacked()); n != 4 {
+		t.Errorf("got wrong unacked length after batch ack: expected 4 got %d", n)
+	}
+
+	b.AckBatch(broker.AckRequest{ConsumeCh: ch, Topic: topic, UpTo: seqs["2"]})
+	unacked := make(map[string]bool)
+	for _, msg := range b.Unacked() {
+		unacked[msg.ID] = true
+	}
+	if len(unacked) != 2 || !unacked["3"] || !unacked["x"] {
+		t.Errorf("expected only messages 3 and x unacked after cumulative ack, got %v", unacked)
+	}
+
+	// renewed subscription gets unacked message 3 back and does not reuse
+	// delivery sequences
+	b.Unsubscribe(broker.SubscribeRequest{Topic: topic, ConsumeCh: ch})
+	b.Register(broker.SubscribeRequest{Topic: topic, ConsumeCh: ch})
+	if msg := <-ch; msg.ID != "3" || msg.DeliverySeq != 6 {
+		t.Errorf("expected message 3 with delivery sequence 6, got %s with %d", msg.ID, msg.DeliverySeq)
+	}
+}
+
+func TestLogTopic(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Stop()
+
+	topic := "events"
+	if err := b.ConfigureTopic(topic, map[string]string{"log": "true"}); err != nil {
+		t.Fatalf("unexpected configure error: %v", err)
+	}
+
+	start := time.Now()
+	for _, id := range []string{"1", "2", "3"} {
+		b.Publish(broker.NewMessage(id, topic, []byte(id)))
+	}
+
+	subscribe := func(group, from string) *testPubSub {
+		t.Helper()
+		tc := newTestPubSub(t, b)
+		sub := broker.SubscribeRequest{Topic: topic, Group: group, ConsumeCh: tc.ch}
+		if from != "" {
+			pos, err := broker.ParsePosition(from)
+			if err != nil {
+				t.Fatalf("unexpected position error: %v", err)
+			}
+			sub.From = pos
+		}
+		if err := b.Register(sub); err != nil {
+			t.Fatalf("unexpected register error: %v", err)
+		}
+		return tc
+	}
+	expect := func(tc *testPubSub, ids ...string) {
+		t.Helper()
+		for _, id := range ids {
+			msg := tc.readMessage()
+			// IDs are offsets of messages
+			if msg.ID != id || fmt.Sprint(msg.Offset) != id {
+				t.Fatalf("got wrong message: expected %s got %s at offset %d", id, msg.ID, msg.Offset)
+			}
+			b.Ack(tc.ch, msg.ID)
+		}
+	}
+
+	// acked messages stay in the log for later groups
+	expect(subscribe("replay", "earliest"), "1", "2", "3")
+	expect(subscribe("", "2"), "2", "3")
+	expect(subscribe("", start.Format(time.RFC3339)), "1", "2", "3")
+
+	latest := subscribe("", "latest")
+	b.Publish(broker.NewMessage("4", topic, []byte("4")))
+	expect(latest, "4")
+
+	if err := b.ConfigureTopic(topic, map[string]string{"log": "false"}); !errors.Is(err, broker.ErrInvalidOption) {
+		t.Errorf("expected invalid option error turning off log with messages, got %v", err)
+	}
+	pos, _ := broker.ParsePosition("earliest")
+	if err := b.Register(broker.SubscribeRequest{Topic: "queue", ConsumeCh: latest.ch, From: pos}); !errors.Is(err, broker.ErrInvalidOption) {
+		t.Errorf("expected invalid option error for start position of queue topic, got %v", err)
+	}
+}
+
+func TestLogRetention(t *testing.T) {
+	b := newTestBroker(t, broker.WithSweepInterval(10*time.Millisecond))
+	defer b.Stop()
+
+	topic := "events"
+	if err := b.ConfigureTopic(topic, map[string]string{"log": "true", "retentionbytes": "2"}); err != nil {
+		t.Fatalf("unexpected configure error: %v", err)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		b.Publish(broker.NewMessage(id, topic, []byte(id)))
+	}
+
+	// retention is applied by the sweeper
+	time.Sleep(100 * time.Millisecond)
+
+	from, _ := broker.ParsePosition("earliest")
+	tc := newTestPubSub(t, b)
+	b.Register(broker.SubscribeRequest{Topic: topic, ConsumeCh: tc.ch, From: from})
+	if got := tc.readMessage(); got.ID != "2" {
+		t.Errorf("expected oldest message over retention to be removed, got %s first", got.ID)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	b := newTestBroker(t, broker.WithSweepInterval(10*time.Millisecond))
+	defer b.Stop()
+
+	topic := "accounts"
+	opts := map[string]string{"log": "true", "compact": "field:id", "tombstoneretention": "0"}
+	if err := b.ConfigureTopic(topic, opts); err != nil {
+		t.Fatalf("unexpected configure error: %v", err)
+	}
+
+	for _, m := range []struct{ id, payload string }{
+		{id: "a1", payload: `{"id": 1, "balance": 10}`},
+		{id: "b1", payload: `{"id": 2, "balance": 5}`},
+		{id: "a2", payload: `{"id": 1, "balance": 20}`},
+		{id: "c1", payload: `{"id": 3, "balance": 1}`},
+	} {
+		if _, err := b.Publish(broker.NewMessage(m.id, topic, []byte(m.payload))); err != nil {
+			t.Fatalf("unexpected publish error: %v", err)
+		}
+	}
+
+	tombstone := broker.NewMessage("c2", topic, nil)
+	tombstone.Key = "3"
+	if _, err := b.Publish(tombstone); err != nil {
+		t.Fatalf("unexpected tombstone publish error: %v", err)
+	}
+	if _, err := b.Publish(broker.NewMessage("", topic, []byte(`{"balance": 1}`))); !errors.Is(err, broker.ErrInvalidOption) {
+		t.Errorf("expected invalid option error for message without key, got %v", err)
+	}
+
+	// compaction is run by the sweeper
+	time.Sleep(100 * time.Millisecond)
+
+	from, _ := broker.ParsePosition("earliest")
+	tc := newTestPubSub(t, b)
+	b.Register(broker.SubscribeRequest{Topic: topic, ConsumeCh: tc.ch, From: from})
+	for _, want := range []string{"b1", "a2"} {
+		got := tc.readMessage()
+		if got.ID != want {
+			t.Errorf("got wrong message of compacted log: expected %s got %s", want, got.ID)
+		}
+		b.Ack(tc.ch, got.ID)
+	}
+
+	select {
+	case msg := <-tc.ch:
+		t.Errorf("got message removed by compaction: %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := b.ConfigureTopic("queue", map[string]string{"compact": "key"}); !errors.Is(err, broker.ErrInvalidOption) {
+		t.Errorf("expected invalid option error compacting topic which is not a log, got %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type compactKind int
+
+const (
+	compactOff compactKind = iota
+	compactMessageKey
+	compactHeader
+	compactField
+)
+
+// CompactKey selects the key by which compaction of a log topic keeps only
+// the latest message. Zero CompactKey disables compaction.
+type CompactKey struct {
+	kind compactKind
+	// name of header or dot separated path of payload field
+	name string
+}
+
+// ParseCompactKey parses "off", "key" for message key, "header:<name>" or
+// "field:<path>" of JSON payload.
+func ParseCompactKey(s string) (CompactKey, error) {
+	switch s {
+	case "off":
+		return CompactKey{}, nil
+	case "key":
+		return CompactKey{kind: compactMessageKey}, nil
+	}
+
+	if name, ok := strings.CutPrefix(s, "header:"); ok && name != "" {
+		return CompactKey{kind: compactHeader, name: name}, nil
+	}
+	if path, ok := strings.CutPrefix(s, "field:"); ok && path != "" {
+		return CompactKey{kind: compactField, name: path}, nil
+	}
+
+	return CompactKey{}, fmt.Errorf("broker: %w: unknown compaction key %q: expected off, key, header:<name> or field:<path>", ErrInvalidOption, s)
+}
+
+func (k CompactKey) Enabled() bool {
+	return k.kind != compactOff
+}
+
+// key returns compaction key of msg. Tombstones have no payload, so with
+// field keys they carry the key as message key.
+func (k CompactKey) key(msg Message) (string, bool) {
+	switch k.kind {
+	case compactHeader:
+		key := msg.Headers[k.name]
+		return key, key != ""
+	case compactField:
+		if len(msg.Payload) > 0 {
+			return payloadField(msg.Payload, k.name)
+		}
+	}
+
+	return msg.Key, msg.Key != ""
+}
+
+// payloadField returns scalar field of JSON object payload at dot separated
+// path as text. Names match case-insensitively, same as in schemas.
+func payloadField(payload []byte, path string) (string, bool) {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+
+	var data any
+	if err := dec.Decode(&data); err != nil {
+		return "", false
+	}
+
+	for _, name := range strings.Split(path, ".") {
+		obj, ok := data.(map[string]any)
+		if !ok {
+			return "", false
+		}
+
+		next, ok := obj[name]
+		if !ok {
+			for key, v := range obj {
+				if strings.EqualFold(key, name) {
+					next, ok = v, true
+					break
+				}
+			}
+		}
+		if !ok {
+			return "", false
+		}
+		data = next
+	}
+
+	switch v := data.(type) {
+	case string:
+		return v, v != ""
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return fmt.Sprint(v), true
+	}
+
+	return "", false
+}
+
+// tombstone is a logged message deleting its key.
+type tombstone struct {
+	offset uint64
+	sentAt time.Time
+}
+
+// indexKey records compaction key of logged msg, so compaction never
+// computes keys again. Message of the same key logged before is marked as
+// superseded.
+func (t *Topic) indexKey(msg Message) {
+	if !t.config.Compact.Enabled() {
+		return
+	}
+
+	key, ok := t.config.Compact.key(msg)
+	if !ok {
+		return
+	}
+	if t.logKeys == nil {
+		t.logKeys = make(map[uint64]string)
+		t.latest = make(map[string]uint64)
+	}
+
+	if prev, ok := t.latest[key]; ok {
+		t.superseded = append(t.superseded, prev)
+	}
+	t.logKeys[msg.Offset] = key
+	t.latest[key] = msg.Offset
+	if len(msg.Payload) == 0 {
+		t.tombstones = append(t.tombstones, tombstone{offset: msg.Offset, sentAt: msg.SentAt})
+	}
+}
+
+// forgetKey drops compaction key of message removed from the log.
+func (t *Topic) forgetKey(offset uint64) {
+	key, ok := t.logKeys[offset]
+	if !ok {
+		return
+	}
+
+	delete(t.logKeys, offset)
+	if t.latest[key] == offset {
+		delete(t.latest, key)
+	}
+}
+
+// reindexLog computes keys of the whole log again after compaction key of
+// the topic changed.
+func (t *Topic) reindexLog() {
+	t.logKeys, t.latest, t.superseded, t.tombstones = nil, nil, nil, nil
+	for _, msg := range t.log {
+		t.indexKey(msg)
+	}
+}
+
+// compactLog removes logged messages superseded since the last compaction
+// and tombstones older than tombstone retention which are still the latest
+// message of their key. Messages logged without a key are kept.
+func (t *Topic) compactLog(now time.Time) []Message {
+	remove := make(map[uint64]bool, len(t.superseded))
+	for _, offset := range t.superseded {
+		remove[offset] = true
+	}
+	t.superseded = nil
+
+	// tombstones expire in the order they were logged
+	for len(t.tombstones) > 0 && now.Sub(t.tombstones[0].sentAt) >= t.config.TombstoneRetention {
+		offset := t.tombstones[0].offset
+		t.tombstones = t.tombstones[1:]
+		if key, ok := t.logKeys[offset]; ok && t.latest[key] == offset {
+			remove[offset] = true
+		}
+	}
+
+	if len(remove) == 0 {
+		return nil
+	}
+
+	var removed []Message
+	kept := t.log[:0]
+	for _, msg := range t.log {
+		if !remove[msg.Offset] {
+			kept = append(kept, msg)
+			continue
+		}
+
+		removed = append(removed, msg)
+		t.logBytes -= int64(len(msg.Payload))
+		t.forgetKey(msg.Offset)
+	}
+	clear(t.log[len(kept):])
+	t.log = kept
+
+	return removed
+}
@@ -0,0 +1,86 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigSuffix is appended to topic name to get the storage log keeping
+// options the topic was configured with.
+const ConfigSuffix = ".$CONFIG"
+
+// storeConfig records opts applied on top of previous options of topic, so
+// its config survives a restart. Record of the previous config is acked.
+func (b *Broker) storeConfig(topic *Topic, opts map[string]string) error {
+	options := maps.Clone(topic.options)
+	if options == nil {
+		options = make(map[string]string, len(opts))
+	}
+	maps.Copy(options, opts)
+
+	payload, err := json.Marshal(options)
+	if err != nil {
+		return fmt.Errorf("broker: marshal config of topic %q: %w", topic.name, err)
+	}
+
+	record := Message{
+		ID:      strconv.FormatUint(topic.configVersion+1, 10),
+		Topic:   topic.name + ConfigSuffix,
+		Payload: payload,
+		SentAt:  time.Now(),
+	}
+	if err := b.storage.Append(record); err != nil {
+		return fmt.Errorf("broker: store config of topic %q: %w", topic.name, err)
+	}
+	b.ackConfig(topic)
+
+	topic.options = options
+	topic.configVersion++
+
+	return nil
+}
+
+// ackConfig acks stored record of the current config of topic.
+func (b *Broker) ackConfig(topic *Topic) {
+	if topic.configVersion == 0 {
+		return
+	}
+
+	if err := b.storage.Ack(topic.name+ConfigSuffix, strconv.FormatUint(topic.configVersion, 10)); err != nil {
+		log.Printf("broker: ack old config of topic %q in storage: %v", topic.name, err)
+	}
+}
+
+// recoverConfig restores topic config from its stored record. Record of an
+// earlier config, left if broker stopped before acking it, is acked.
+func (b *Broker) recoverConfig(record Message) error {
+	version, err := strconv.ParseUint(record.ID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("broker: wrong config version %q in %q: %w", record.ID, record.Topic, err)
+	}
+
+	var options map[string]string
+	if err := json.Unmarshal(record.Payload, &options); err != nil {
+		return fmt.Errorf("broker: wrong config %s in %q: %w", record.ID, record.Topic, err)
+	}
+
+	cfg := DefaultTopicConfig()
+	if err := cfg.Apply(options); err != nil {
+		return fmt.Errorf("broker: recover config in %q: %w", record.Topic, err)
+	}
+
+	// records are loaded in the order they were stored
+	topic := b.getOrCreateTopic(strings.TrimSuffix(record.Topic, ConfigSuffix))
+	b.ackConfig(topic)
+
+	topic.config = cfg
+	topic.options = options
+	topic.configVersion = version
+
+	return nil
+}
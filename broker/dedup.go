@@ -0,0 +1,54 @@
+package broker
+
+import "time"
+
+type dedupEntry struct {
+	key string
+	at  time.Time
+}
+
+// dedupWindow remembers IDs of messages recently published with an
+// idempotency key, so that retried publishes return the original message
+// instead of queueing a copy.
+type dedupWindow struct {
+	ids map[string]string
+	// keys holds dedupEntry values in publish order for eviction
+	keys *Queue
+}
+
+func newDedupWindow() *dedupWindow {
+	return &dedupWindow{ids: make(map[string]string), keys: NewQueue()}
+}
+
+// lookup returns ID of the message published with key within the window.
+func (w *dedupWindow) lookup(key string) (string, bool) {
+	id, ok := w.ids[key]
+	return id, ok
+}
+
+func (w *dedupWindow) add(key, msgID string, now time.Time) {
+	if _, ok := w.ids[key]; ok {
+		return
+	}
+
+	w.ids[key] = msgID
+	w.keys.Enqueue(dedupEntry{key: key, at: now})
+}
+
+// evict forgets keys older than window and the oldest keys above limit.
+func (w *dedupWindow) evict(now time.Time, window time.Duration, limit int) {
+	for {
+		front, ok := w.keys.Peek()
+		if !ok {
+			return
+		}
+
+		entry := front.(dedupEntry)
+		if now.Sub(entry.at) < window && (limit <= 0 || w.keys.Len() <= limit) {
+			return
+		}
+
+		w.keys.Dequeue()
+		delete(w.ids, entry.key)
+	}
+}
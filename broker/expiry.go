@@ -0,0 +1,37 @@
+package broker
+
+import "time"
+
+// sweepExpired removes expired messages from queues of every topic, including
+// topics nobody consumes from.
+func (b *Broker) sweepExpired(now time.Time) {
+	expired := make(map[*Topic][]Message)
+
+	b.topics.mu.RLock()
+	for _, t := range b.topics.m {
+		if msgs := t.removeExpired(now); len(msgs) > 0 {
+			expired[t] = msgs
+		}
+	}
+	b.topics.mu.RUnlock()
+
+	for t, msgs := range expired {
+		for _, msg := range msgs {
+			b.expire(t, msg)
+		}
+	}
+}
+
+// expire counts expired message copy and drops or dead-letters it according
+// to topic config.
+func (b *Broker) expire(topic *Topic, msg Message) {
+	topic.expired++
+
+	if topic.config.Expiry == ExpiryDeadLetter {
+		msg.Reason = reasonExpired
+		b.deadLetter(topic, msg)
+		return
+	}
+
+	b.release(topic, msg)
+}
@@ -0,0 +1,124 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+)
+
+// FetchRequest asks for queued messages of a topic for a pull consumer.
+type FetchRequest struct {
+	Topic string
+	// Group is optional consumer group name, same as for subscriptions.
+	Group string
+	// ConsumeCh identifies the consumer, fetched messages are acked and
+	// nacked with it but never sent to it.
+	ConsumeCh chan Message
+	// Max is the most messages returned at once.
+	Max int
+	// Wait is how long to wait for messages when none are queued.
+	Wait time.Duration
+}
+
+type fetchRequest struct {
+	req     FetchRequest
+	replyCh chan fetchReply
+}
+
+type fetchReply struct {
+	msgs []Message
+	err  error
+}
+
+// pendingFetch collects messages for a pull consumer until its fetch is
+// answered.
+type pendingFetch struct {
+	max     int
+	msgs    []Message
+	replyCh chan fetchReply
+}
+
+func (f *pendingFetch) full() bool {
+	return len(f.msgs) >= f.max
+}
+
+// Fetch returns up to req.Max messages delivered to the pull consumer of
+// req.ConsumeCh, subscribing it on the first fetch. Without queued messages
+// it waits up to req.Wait for some to arrive. Fetched messages stay unacked
+// until acked, same as pushed ones. A consumer has one fetch at a time, fetch
+// made while another is pending fails with ErrInvalidOption.
+func (b *Broker) Fetch(req FetchRequest) ([]Message, error) {
+	replyCh := make(chan fetchReply, 1)
+	b.fetchCh <- fetchRequest{req: req, replyCh: replyCh}
+
+	reply := <-replyCh
+	return reply.msgs, reply.err
+}
+
+func (b *Broker) fetch(req fetchRequest) {
+	c, err := b.pullConsumer(req.req)
+	if err != nil {
+		req.replyCh <- fetchReply{err: err}
+		return
+	}
+	if c.fetch != nil {
+		req.replyCh <- fetchReply{err: fmt.Errorf("broker: %w: fetch from topic %q is already pending", ErrInvalidOption, req.req.Topic)}
+		return
+	}
+
+	f := &pendingFetch{max: req.req.Max, replyCh: req.replyCh}
+	c.fetch = f
+	b.deliverMessages()
+	if c.fetch == nil {
+		return
+	}
+
+	if req.req.Wait <= 0 {
+		c.completeFetch()
+		return
+	}
+
+	b.scheduler.schedule(time.Now().Add(req.req.Wait), func() {
+		if c.fetch == f {
+			c.completeFetch()
+		}
+	})
+}
+
+// pullConsumer returns pull consumer of req, attaching it to the topic on
+// the first fetch.
+func (b *Broker) pullConsumer(req FetchRequest) (*Consumer, error) {
+	if err := ValidateTopic(req.Topic); err != nil {
+		return nil, err
+	}
+	if IsWildcard(req.Topic) {
+		return nil, fmt.Errorf("broker: %w: can not fetch from pattern %q", ErrInvalidTopic, req.Topic)
+	}
+	if req.Max <= 0 {
+		return nil, fmt.Errorf("broker: %w: fetch size %d must be positive", ErrInvalidOption, req.Max)
+	}
+
+	topic := b.getOrCreateTopic(req.Topic)
+	for _, c := range b.consumers[req.ConsumeCh] {
+		if c.topic != topic || c.group.name != req.Group || c.pattern != "" {
+			continue
+		}
+		if !c.pull {
+			return nil, fmt.Errorf("broker: %w: topic %q is already subscribed", ErrInvalidOption, req.Topic)
+		}
+
+		return c, nil
+	}
+
+	c := topic.addConsumer(req.ConsumeCh, req.Group, "", Position{})
+	c.seq = b.sequence(req.ConsumeCh, req.Topic)
+	c.pull = true
+	b.consumers[req.ConsumeCh] = append(b.consumers[req.ConsumeCh], c)
+
+	return c, nil
+}
+
+// completeFetch answers pending fetch of c with messages collected so far.
+func (c *Consumer) completeFetch() {
+	c.fetch.replyCh <- fetchReply{msgs: c.fetch.msgs}
+	c.fetch = nil
+}
@@ -0,0 +1,35 @@
+package broker
+
+import (
+	"fmt"
+	"strings"
+)
+
+// InboxPrefix starts names of ephemeral reply topics. An inbox exists only
+// while it has subscribers, publishing to a missing inbox fails with
+// ErrTopicNotFound instead of creating it.
+const InboxPrefix = "_INBOX."
+
+func IsInbox(topic string) bool {
+	return strings.HasPrefix(topic, InboxPrefix)
+}
+
+// NewInbox returns unique inbox topic name.
+func NewInbox() (string, error) {
+	id, err := generateMessageID()
+	if err != nil {
+		return "", fmt.Errorf("broker: generate inbox: %w", err)
+	}
+
+	return InboxPrefix + id, nil
+}
+
+// dropInbox removes inbox topic once it has no groups left, together with
+// messages nobody is waiting for anymore. They were never stored.
+func (b *Broker) dropInbox(topic *Topic) {
+	if len(topic.groups) > 0 {
+		return
+	}
+
+	b.topics.Delete(topic.name)
+}
@@ -0,0 +1,248 @@
+package broker
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OffsetsSuffix is appended to topic name to get the storage log keeping
+// committed offsets of its named groups.
+const OffsetsSuffix = ".$OFFSETS"
+
+type positionKind int
+
+const (
+	// positionDefault resumes named group from its committed offset, other
+	// groups start at the end of the log
+	positionDefault positionKind = iota
+	positionEarliest
+	positionLatest
+	positionOffset
+	positionTime
+)
+
+// Position is where a new group of a log topic starts reading. Zero
+// Position resumes named group from its committed offset and starts other
+// groups at the end of the log.
+type Position struct {
+	kind   positionKind
+	offset uint64
+	time   time.Time
+}
+
+// ParsePosition parses "earliest", "latest", an offset or an RFC3339 time of
+// the first message to read.
+func ParsePosition(s string) (Position, error) {
+	switch s {
+	case "earliest":
+		return Position{kind: positionEarliest}, nil
+	case "latest":
+		return Position{kind: positionLatest}, nil
+	}
+
+	if offset, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return Position{kind: positionOffset, offset: offset}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return Position{kind: positionTime, time: t}, nil
+	}
+
+	return Position{}, fmt.Errorf("broker: %w: wrong position %q: expected earliest, latest, offset or RFC3339 time", ErrInvalidOption, s)
+}
+
+// appendLog records published message of a log topic.
+func (t *Topic) appendLog(msg Message) {
+	t.log = append(t.log, msg)
+	t.logBytes += int64(len(msg.Payload))
+	t.lastOffset = max(t.lastOffset, msg.Offset)
+	t.indexKey(msg)
+}
+
+// start returns offset new group g reads the log from.
+func (t *Topic) start(g *group, from Position) uint64 {
+	switch from.kind {
+	case positionEarliest:
+		return 0
+	case positionOffset:
+		return from.offset
+	case positionTime:
+		for _, msg := range t.log {
+			if !msg.SentAt.Before(from.time) {
+				return msg.Offset
+			}
+		}
+	case positionDefault:
+		if committed, ok := t.committed[g.name]; ok && g.name != "" {
+			return committed
+		}
+	}
+
+	return t.lastOffset + 1
+}
+
+// replay queues logged messages from offset start for new group g.
+func (t *Topic) replay(g *group, start uint64) {
+	g.logNext = start
+
+	i := sort.Search(len(t.log), func(i int) bool {
+		return t.log[i].Offset >= start
+	})
+	for _, msg := range t.log[i:] {
+		g.push(msg)
+		t.refs[msg.ID]++
+	}
+}
+
+// trimLog removes logged messages beyond topic retention and returns them.
+func (t *Topic) trimLog(now time.Time) []Message {
+	n := 0
+	for ; n < len(t.log); n++ {
+		msg := t.log[n]
+		tooOld := t.config.Retention > 0 && now.Sub(msg.SentAt) > t.config.Retention
+		tooBig := t.config.RetentionBytes > 0 && t.logBytes > t.config.RetentionBytes
+		if !tooOld && !tooBig {
+			break
+		}
+
+		t.logBytes -= int64(len(msg.Payload))
+		t.forgetKey(msg.Offset)
+	}
+
+	trimmed := slices.Clone(t.log[:n])
+	t.log = slices.Delete(t.log, 0, n)
+
+	return trimmed
+}
+
+// push queues message for the group. Offsets of log messages are remembered
+// until the group is done with them.
+func (g *group) push(msg Message) {
+	if msg.Offset > 0 {
+		if g.outstanding == nil {
+			g.outstanding = make(map[uint64]bool)
+		}
+		g.outstanding[msg.Offset] = true
+		g.logNext = max(g.logNext, msg.Offset+1)
+	}
+
+	msg.group = g.name
+	g.queue.Enqueue(msg)
+}
+
+// done records that group will not deliver message again.
+func (g *group) done(msg Message) {
+	delete(g.outstanding, msg.Offset)
+}
+
+// committedOffset is where group resumes reading after restart, it is done
+// with every message before it.
+func (g *group) committedOffset() uint64 {
+	committed := g.logNext
+	for offset := range g.outstanding {
+		committed = min(committed, offset)
+	}
+
+	return committed
+}
+
+// cleanLogs removes messages beyond retention or superseded by compaction
+// from log topics, they are acked in storage even if some group has not
+// consumed them yet.
+func (b *Broker) cleanLogs(now time.Time) {
+	b.topics.mu.RLock()
+	defer b.topics.mu.RUnlock()
+
+	for _, t := range b.topics.m {
+		if !t.config.Log {
+			continue
+		}
+
+		for _, msg := range append(t.trimLog(now), t.compactLog(now)...) {
+			if err := b.storage.Ack(t.name, msg.ID); err != nil {
+				log.Printf("broker: ack removed message %s in storage: %v", msg.ID, err)
+			}
+		}
+	}
+}
+
+// commitOffsets stores committed offsets of named groups of log topics
+// which changed since they were last stored. Record of the previously
+// stored offset is acked, so storage keeps one record per group.
+func (b *Broker) commitOffsets() {
+	b.topics.mu.RLock()
+	defer b.topics.mu.RUnlock()
+
+	for _, t := range b.topics.m {
+		if !t.config.Log {
+			continue
+		}
+
+		for _, g := range t.groups {
+			if g.name == "" {
+				continue
+			}
+
+			offset := g.committedOffset()
+			if stored, ok := t.committed[g.name]; ok && stored == offset {
+				continue
+			}
+
+			record := Message{
+				ID:      offsetRecordID(g.name, offset),
+				Topic:   t.name + OffsetsSuffix,
+				Key:     g.name,
+				Payload: []byte(strconv.FormatUint(offset, 10)),
+				SentAt:  time.Now(),
+			}
+			if err := b.storage.Append(record); err != nil {
+				log.Printf("broker: store offset of group %q of topic %q: %v", g.name, t.name, err)
+				continue
+			}
+			b.ackOffset(t, g.name)
+			t.committed[g.name] = offset
+		}
+	}
+}
+
+// offsetRecordID returns ID of the record storing offset of group, every
+// stored offset gets its own record so the previous one can be acked.
+func offsetRecordID(group string, offset uint64) string {
+	return group + "@" + strconv.FormatUint(offset, 10)
+}
+
+// ackOffset acks record of the stored offset of group, if any.
+func (b *Broker) ackOffset(t *Topic, group string) {
+	stored, ok := t.committed[group]
+	if !ok {
+		return
+	}
+
+	if err := b.storage.Ack(t.name+OffsetsSuffix, offsetRecordID(group, stored)); err != nil {
+		log.Printf("broker: ack old offset of group %q of topic %q in storage: %v", group, t.name, err)
+	}
+}
+
+// recoverOffset restores committed offset of a named group from its stored
+// record. Record of an earlier offset, left if broker stopped before acking
+// it, is acked.
+func (b *Broker) recoverOffset(record Message) error {
+	offset, err := strconv.ParseUint(string(record.Payload), 10, 64)
+	if err != nil {
+		return fmt.Errorf("broker: wrong offset of group %q in %q: %w", record.Key, record.Topic, err)
+	}
+
+	// offsets keep growing even if retention removed every logged message
+	topic := b.getOrCreateTopic(strings.TrimSuffix(record.Topic, OffsetsSuffix))
+	b.ackOffset(topic, record.Key)
+	topic.committed[record.Key] = offset
+	if offset > 0 {
+		topic.lastOffset = max(topic.lastOffset, offset-1)
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package broker
+
+// outbox holds messages taken by a push consumer until its channel has
+// room, up to prefetch messages or one without prefetch limit. Broker is
+// signalled every time outbox empties, so backlog flows as fast as the
+// consumer reads instead of waiting for the deliver ticker.
+type outbox struct {
+	msgs chan Message
+	quit chan struct{}
+	done chan struct{}
+}
+
+func newOutbox(size int, ch chan Message, drained func()) *outbox {
+	o := &outbox{
+		msgs: make(chan Message, max(size, 1)),
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go o.run(ch, drained)
+
+	return o
+}
+
+func (o *outbox) run(ch chan Message, drained func()) {
+	defer close(o.done)
+
+	for {
+		select {
+		case msg := <-o.msgs:
+			select {
+			case ch <- msg:
+				if len(o.msgs) == 0 {
+					drained()
+				}
+			case <-o.quit:
+				return
+			}
+		case <-o.quit:
+			return
+		}
+	}
+}
+
+// put takes message without blocking and reports whether there was room.
+func (o *outbox) put(msg Message) bool {
+	select {
+	case o.msgs <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop returns once outbox no longer sends to consumer channel, messages
+// left in it are never sent.
+func (o *outbox) stop() {
+	if o == nil {
+		return
+	}
+
+	close(o.quit)
+	<-o.done
+}
@@ -4,33 +4,133 @@ import (
 	"container/list"
 )
 
+// Queue is FIFO queue with optional priority levels: values of a higher
+// level are dequeued first, values of the same level in FIFO order.
 type Queue struct {
-	list *list.List
+	// levels are ordered from the lowest priority to the highest
+	levels   []*list.List
+	priority func(any) int
 }
 
 func NewQueue() *Queue {
-	return &Queue{list: list.New()}
+	return &Queue{levels: []*list.List{list.New()}}
+}
+
+// NewPriorityQueue creates queue with priority levels from 0 to maxPriority,
+// priority returns level of a value and is clamped to that range.
+func NewPriorityQueue(maxPriority int, priority func(any) int) *Queue {
+	levels := make([]*list.List, maxPriority+1)
+	for i := range levels {
+		levels[i] = list.New()
+	}
+
+	return &Queue{levels: levels, priority: priority}
+}
+
+func (q Queue) level(data any) *list.List {
+	if q.priority == nil {
+		return q.levels[0]
+	}
+
+	return q.levels[min(max(q.priority(data), 0), len(q.levels)-1)]
+}
+
+// front returns the highest non-empty level.
+func (q Queue) front() *list.List {
+	for i := len(q.levels) - 1; i >= 0; i-- {
+		if q.levels[i].Len() > 0 {
+			return q.levels[i]
+		}
+	}
+
+	return nil
 }
 
 func (q Queue) Enqueue(data any) {
-	q.list.PushBack(data)
+	q.level(data).PushBack(data)
+}
+
+// PushFront puts data before other values of its level.
+func (q Queue) PushFront(data any) {
+	q.level(data).PushFront(data)
 }
 
 func (q Queue) Dequeue() (any, bool) {
-	if q.list.Len() == 0 {
+	l := q.front()
+	if l == nil {
 		return nil, false
 	}
 
-	val := q.list.Front()
-	q.list.Remove(val)
+	return l.Remove(l.Front()), true
+}
 
-	return val.Value, true
+// Peek returns front value without removing it.
+func (q Queue) Peek() (any, bool) {
+	l := q.front()
+	if l == nil {
+		return nil, false
+	}
+
+	return l.Front().Value, true
 }
 
 func (q Queue) Len() int {
-	return q.list.Len()
+	n := 0
+	for _, l := range q.levels {
+		n += l.Len()
+	}
+
+	return n
 }
 
 func (q Queue) Empty() bool {
 	return q.Len() == 0
 }
+
+// Items returns queued values in dequeue order.
+func (q Queue) Items() []any {
+	items := make([]any, 0, q.Len())
+	for i := len(q.levels) - 1; i >= 0; i-- {
+		for e := q.levels[i].Front(); e != nil; e = e.Next() {
+			items = append(items, e.Value)
+		}
+	}
+
+	return items
+}
+
+// Scan visits values in dequeue order, removing those visit asks to, until
+// visit asks to stop.
+func (q Queue) Scan(visit func(any) (remove, stop bool)) {
+	for i := len(q.levels) - 1; i >= 0; i-- {
+		l := q.levels[i]
+		for e := l.Front(); e != nil; {
+			next := e.Next()
+			remove, stop := visit(e.Value)
+			if remove {
+				l.Remove(e)
+			}
+			if stop {
+				return
+			}
+			e = next
+		}
+	}
+}
+
+// RemoveFunc removes every value match reports true for and returns them.
+func (q Queue) RemoveFunc(match func(any) bool) []any {
+	var removed []any
+	for i := len(q.levels) - 1; i >= 0; i-- {
+		l := q.levels[i]
+		for e := l.Front(); e != nil; {
+			next := e.Next()
+			if match(e.Value) {
+				removed = append(removed, l.Remove(e))
+			}
+			e = next
+		}
+	}
+
+	return removed
+}
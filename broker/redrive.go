@@ -0,0 +1,165 @@
+package broker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RedriveRequest selects dead-lettered messages to move back to the topics
+// they came from. Zero values of filters match every message.
+type RedriveRequest struct {
+	// Topic is the dead-letter topic to take messages from.
+	Topic string
+	IDs   []string
+	// OlderThan and NewerThan filter messages by time since they were sent.
+	OlderThan time.Duration
+	NewerThan time.Duration
+	// DryRun only lists messages which would be moved.
+	DryRun bool
+}
+
+// Apply sets request filters from textual options, as sent with REDRIVE command.
+func (r *RedriveRequest) Apply(opts map[string]string) error {
+	for key, val := range opts {
+		switch key {
+		case "ids":
+			r.IDs = strings.Split(val, ",")
+		case "older":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("broker: %w: wrong redrive age %q: %w", ErrInvalidOption, val, err)
+			}
+			r.OlderThan = d
+		case "newer":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("broker: %w: wrong redrive age %q: %w", ErrInvalidOption, val, err)
+			}
+			r.NewerThan = d
+		case "dryrun":
+			dryRun, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("broker: %w: wrong redrive dry run %q: %w", ErrInvalidOption, val, err)
+			}
+			r.DryRun = dryRun
+		default:
+			return fmt.Errorf("broker: %w: unknown redrive option %q", ErrInvalidOption, key)
+		}
+	}
+
+	return nil
+}
+
+func (r RedriveRequest) match(msg Message, now time.Time) bool {
+	if msg.OriginTopic == "" {
+		return false
+	}
+
+	if len(r.IDs) > 0 && !containsItem(r.IDs, msg.ID) {
+		return false
+	}
+
+	age := now.Sub(msg.SentAt)
+	if r.OlderThan > 0 && age < r.OlderThan {
+		return false
+	}
+	if r.NewerThan > 0 && age > r.NewerThan {
+		return false
+	}
+
+	return true
+}
+
+type redriveRequest struct {
+	req     RedriveRequest
+	replyCh chan redriveResult
+}
+
+type redriveResult struct {
+	msgs []Message
+	err  error
+}
+
+// Redrive moves matching queued messages of a dead-letter topic back to their
+// origin topics, keeping message ID and sent time. Messages currently
+// delivered to dead-letter topic subscribers are left alone. It returns
+// messages as they were in the dead-letter topic. When a message can not be
+// republished, redrive stops and returns messages moved before it together
+// with the error, they are no longer in the dead-letter topic.
+func (b *Broker) Redrive(req RedriveRequest) ([]Message, error) {
+	replyCh := make(chan redriveResult, 1)
+	b.redriveCh <- redriveRequest{req: req, replyCh: replyCh}
+
+	res := <-replyCh
+	return res.msgs, res.err
+}
+
+func (b *Broker) redrive(req RedriveRequest) ([]Message, error) {
+	topic, ok := b.topics.Get(req.Topic)
+	if !ok {
+		return nil, fmt.Errorf("broker: redrive: %w: %q", ErrTopicNotFound, req.Topic)
+	}
+
+	groupQueues := make([]*Queue, 0, len(topic.groups))
+	for _, g := range topic.groups {
+		groupQueues = append(groupQueues, g.queue)
+	}
+
+	now := time.Now()
+	var msgs []Message
+	matched := make(map[string]bool)
+	for _, q := range append([]*Queue{topic.queue}, groupQueues...) {
+		for _, item := range q.Items() {
+			msg := item.(Message)
+			if matched[msg.ID] || !req.match(msg, now) {
+				continue
+			}
+
+			matched[msg.ID] = true
+			msgs = append(msgs, msg)
+		}
+	}
+
+	if req.DryRun {
+		return msgs, nil
+	}
+
+	// origin copy is stored before dead-lettered one is acked, same as
+	// when message is dead-lettered
+	var (
+		moved    []Message
+		movedIDs = make(map[string]bool)
+		err      error
+	)
+	for _, msg := range msgs {
+		redriven := msg
+		redriven.Topic = msg.OriginTopic
+		redriven.OriginTopic = ""
+		redriven.OriginAttempts = 0
+		redriven.Attempts = 0
+		redriven.Reason = ""
+		redriven.DeliveredAt = time.Time{}
+		redriven.DedupKey = ""
+		if _, err = b.publish(redriven); err != nil {
+			err = fmt.Errorf("broker: redrive message %s after moving %d messages: %w", msg.ID, len(moved), err)
+			break
+		}
+
+		moved = append(moved, msg)
+		movedIDs[msg.ID] = true
+	}
+
+	isMoved := func(item any) bool {
+		return movedIDs[item.(Message).ID]
+	}
+
+	for _, q := range append([]*Queue{topic.queue}, groupQueues...) {
+		for _, item := range q.RemoveFunc(isMoved) {
+			b.release(topic, item.(Message))
+		}
+	}
+
+	return moved, err
+}
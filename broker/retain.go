@@ -0,0 +1,61 @@
+package broker
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// RetainedSuffix is appended to topic name to get the storage log keeping
+// retained message of the topic.
+const RetainedSuffix = ".$RETAINED"
+
+// retain makes msg the retained message of topic. Its copy is stored
+// separately, so it survives the message being acked.
+func (b *Broker) retain(topic *Topic, msg Message) error {
+	record := msg
+	record.Topic = topic.name + RetainedSuffix
+	if err := b.storage.Append(record); err != nil {
+		return fmt.Errorf("broker: append retained message %s to storage: %w", msg.ID, err)
+	}
+
+	if topic.retained != nil && topic.retained.ID != msg.ID {
+		b.clearRetained(topic)
+	}
+	topic.retained = &msg
+
+	return nil
+}
+
+func (b *Broker) clearRetained(topic *Topic) {
+	if topic.retained == nil {
+		return
+	}
+
+	if err := b.storage.Ack(topic.name+RetainedSuffix, topic.retained.ID); err != nil {
+		log.Printf("broker: ack retained message %s in storage: %v", topic.retained.ID, err)
+	}
+	topic.retained = nil
+}
+
+// recoverRetained restores retained message from its stored copy.
+func (b *Broker) recoverRetained(record Message) {
+	msg := record
+	msg.Topic = strings.TrimSuffix(record.Topic, RetainedSuffix)
+	b.getOrCreateTopic(msg.Topic).retained = &msg
+}
+
+// retainedCopy returns retained message to deliver to a new subscriber, if
+// it is visible and not expired.
+func (t *Topic) retainedCopy(now time.Time) (Message, bool) {
+	if t.retained == nil || t.retained.NotBefore.After(now) || t.retained.expired(now) {
+		return Message{}, false
+	}
+
+	msg := *t.retained
+	msg.Attempts = 0
+	msg.DeliveredAt = time.Time{}
+
+	return msg, true
+}
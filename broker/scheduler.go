@@ -0,0 +1,82 @@
+package broker
+
+import (
+	"container/heap"
+	"time"
+)
+
+type timerItem struct {
+	at  time.Time
+	seq uint64
+	fn  func()
+}
+
+type timerHeap []*timerItem
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+
+	return h[i].at.Before(h[j].at)
+}
+
+func (h timerHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *timerHeap) Push(x any) { *h = append(*h, x.(*timerItem)) }
+
+func (h *timerHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+
+	return item
+}
+
+// scheduler runs functions at given time on the broker goroutine. A single
+// timer is armed for the earliest function.
+type scheduler struct {
+	items timerHeap
+	seq   uint64
+	timer *time.Timer
+}
+
+func newScheduler() *scheduler {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	return &scheduler{timer: timer}
+}
+
+func (s *scheduler) C() <-chan time.Time {
+	return s.timer.C
+}
+
+func (s *scheduler) schedule(at time.Time, fn func()) {
+	s.seq++
+	heap.Push(&s.items, &timerItem{at: at, seq: s.seq, fn: fn})
+
+	if s.items[0].seq == s.seq {
+		s.timer.Reset(time.Until(at))
+	}
+}
+
+// runDue runs every function scheduled up to now and rearms the timer.
+func (s *scheduler) runDue(now time.Time) {
+	for len(s.items) > 0 && !s.items[0].at.After(now) {
+		item := heap.Pop(&s.items).(*timerItem)
+		item.fn()
+	}
+
+	if len(s.items) > 0 {
+		s.timer.Reset(time.Until(s.items[0].at))
+	}
+}
+
+func (s *scheduler) stop() {
+	s.timer.Stop()
+}
@@ -0,0 +1,28 @@
+package broker
+
+// Storage persists published messages and their acknowledgements so that
+// broker state survives a restart.
+type Storage interface {
+	// Append durably records a newly published message.
+	Append(msg Message) error
+	// Ack records that a message was fully processed and will never be
+	// delivered again.
+	Ack(topic, msgID string) error
+	// Load returns every message that was appended but not acked, in
+	// publish order for each topic.
+	Load() ([]Message, error)
+	Close() error
+}
+
+type memoryStorage struct{}
+
+// NewMemoryStorage returns storage which keeps nothing, messages live only in
+// broker queues.
+func NewMemoryStorage() Storage {
+	return memoryStorage{}
+}
+
+func (memoryStorage) Append(Message) error     { return nil }
+func (memoryStorage) Ack(string, string) error { return nil }
+func (memoryStorage) Load() ([]Message, error) { return nil, nil }
+func (memoryStorage) Close() error             { return nil }
@@ -0,0 +1,949 @@
+package broker
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vlaner/postal/filter"
+	"github.com/vlaner/postal/schema"
+)
+
+type DeliveryMode string
+
+const (
+	// DeliveryFanout sends every message to every subscriber of a topic.
+	DeliveryFanout DeliveryMode = "fanout"
+	// DeliveryRoundRobin sends every message to exactly one subscriber,
+	// taking turns between subscribers.
+	DeliveryRoundRobin DeliveryMode = "roundrobin"
+	// DeliveryLeastLoaded sends every message to exactly one subscriber,
+	// picking the one with the fewest unacked messages.
+	DeliveryLeastLoaded DeliveryMode = "leastloaded"
+)
+
+func ParseDeliveryMode(s string) (DeliveryMode, error) {
+	switch mode := DeliveryMode(s); mode {
+	case DeliveryFanout, DeliveryRoundRobin, DeliveryLeastLoaded:
+		return mode, nil
+	}
+
+	return "", fmt.Errorf("broker: %w: unknown delivery mode %q", ErrInvalidOption, s)
+}
+
+type ExpiryAction string
+
+const (
+	// ExpiryDrop discards expired messages.
+	ExpiryDrop ExpiryAction = "drop"
+	// ExpiryDeadLetter moves expired messages to the dead-letter topic.
+	ExpiryDeadLetter ExpiryAction = "deadletter"
+)
+
+func ParseExpiryAction(s string) (ExpiryAction, error) {
+	switch action := ExpiryAction(s); action {
+	case ExpiryDrop, ExpiryDeadLetter:
+		return action, nil
+	}
+
+	return "", fmt.Errorf("broker: %w: unknown expiry action %q", ErrInvalidOption, s)
+}
+
+// DeadLetterSuffix is appended to topic name to get its default
+// dead-letter topic.
+const DeadLetterSuffix = ".$DLQ"
+
+// RetryPolicy computes how long a failed message waits before it is
+// delivered again. Zero policy redelivers immediately.
+type RetryPolicy struct {
+	InitialDelay time.Duration
+	// Multiplier grows delay after every failed attempt.
+	Multiplier float64
+	MaxDelay   time.Duration
+	// Jitter randomizes delay by up to this fraction in both directions.
+	Jitter float64
+}
+
+// Delay returns backoff before the next delivery of a message which failed
+// its attempts-th delivery.
+func (p RetryPolicy) Delay(attempts int) time.Duration {
+	if p.InitialDelay <= 0 {
+		return 0
+	}
+
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := float64(p.InitialDelay) * math.Pow(multiplier, float64(max(attempts-1, 0)))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(delay)
+}
+
+// InvalidSuffix is appended to topic name to get the topic which collects
+// rejected messages when RouteInvalid is set.
+const InvalidSuffix = ".$INVALID"
+
+// internalSuffixes end names of storage logs keeping broker state, clients
+// can not publish to them.
+var internalSuffixes = []string{RetainedSuffix, OffsetsSuffix, ConfigSuffix}
+
+// internalSuffix returns suffix of the storage log of broker state topic
+// name ends with.
+func internalSuffix(topic string) (string, bool) {
+	for _, suffix := range internalSuffixes {
+		if strings.HasSuffix(topic, suffix) {
+			return suffix, true
+		}
+	}
+
+	return "", false
+}
+
+func isInternalTopic(topic string) bool {
+	_, ok := internalSuffix(topic)
+	return ok
+}
+
+type TopicConfig struct {
+	Delivery DeliveryMode
+	// AckTimeout is how long a consumer has to ack a message before it is
+	// redelivered.
+	AckTimeout time.Duration
+	Retry      RetryPolicy
+	// MaxDeliveries is how many times a message is delivered before it is
+	// moved to the dead-letter topic, zero means no limit.
+	MaxDeliveries int
+	// DeadLetter overrides the default <topic>.$DLQ dead-letter topic.
+	DeadLetter string
+	// RouteInvalid copies messages rejected by topic schema to
+	// <topic>.$INVALID for inspection.
+	RouteInvalid bool
+	// DedupWindow is how long idempotency keys of published messages are
+	// remembered, zero disables deduplication.
+	DedupWindow time.Duration
+	// DedupMax limits how many keys are remembered, zero means no limit.
+	DedupMax int
+	// TTL is how long messages published without their own expiry time
+	// wait for delivery, zero means forever.
+	TTL    time.Duration
+	Expiry ExpiryAction
+	// Log keeps messages after delivery so new groups can replay them,
+	// until they are older than Retention or the log grows over
+	// RetentionBytes. Zero retention limits keep messages forever.
+	Log            bool
+	Retention      time.Duration
+	RetentionBytes int64
+	// Compact keeps only the latest message of every key in a log topic.
+	// Message with empty payload is a tombstone deleting its key, it is
+	// kept for TombstoneRetention so consumers can see it.
+	Compact            CompactKey
+	TombstoneRetention time.Duration
+}
+
+func DefaultTopicConfig() TopicConfig {
+	return TopicConfig{
+		Delivery:    DeliveryFanout,
+		AckTimeout:  5 * time.Second,
+		DedupWindow: 2 * time.Minute,
+		DedupMax:    100000,
+		Expiry:      ExpiryDrop,
+		// tombstones live long enough for consumers to see them
+		TombstoneRetention: time.Hour,
+	}
+}
+
+// Apply sets config fields from textual options, as sent with CONFIG command.
+func (c *TopicConfig) Apply(opts map[string]string) error {
+	for key, val := range opts {
+		switch key {
+		case "delivery":
+			mode, err := ParseDeliveryMode(val)
+			if err != nil {
+				return err
+			}
+			c.Delivery = mode
+		case "maxdeliveries":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return fmt.Errorf("broker: %w: wrong max deliveries %q", ErrInvalidOption, val)
+			}
+			c.MaxDeliveries = n
+		case "deadletter":
+			c.DeadLetter = val
+		case "routeinvalid":
+			route, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("broker: %w: wrong route invalid %q", ErrInvalidOption, val)
+			}
+			c.RouteInvalid = route
+		case "dedupwindow":
+			d, err := time.ParseDuration(val)
+			if err != nil || d < 0 {
+				return fmt.Errorf("broker: %w: wrong dedup window %q", ErrInvalidOption, val)
+			}
+			c.DedupWindow = d
+		case "dedupmax":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return fmt.Errorf("broker: %w: wrong dedup max %q", ErrInvalidOption, val)
+			}
+			c.DedupMax = n
+		case "ttl":
+			d, err := time.ParseDuration(val)
+			if err != nil || d < 0 {
+				return fmt.Errorf("broker: %w: wrong ttl %q", ErrInvalidOption, val)
+			}
+			c.TTL = d
+		case "expiry":
+			action, err := ParseExpiryAction(val)
+			if err != nil {
+				return err
+			}
+			c.Expiry = action
+		case "log":
+			enabled, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("broker: %w: wrong log %q", ErrInvalidOption, val)
+			}
+			c.Log = enabled
+		case "retention":
+			d, err := time.ParseDuration(val)
+			if err != nil || d < 0 {
+				return fmt.Errorf("broker: %w: wrong retention %q", ErrInvalidOption, val)
+			}
+			c.Retention = d
+		case "retentionbytes":
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("broker: %w: wrong retention bytes %q", ErrInvalidOption, val)
+			}
+			c.RetentionBytes = n
+		case "compact":
+			key, err := ParseCompactKey(val)
+			if err != nil {
+				return err
+			}
+			c.Compact = key
+		case "tombstoneretention":
+			d, err := time.ParseDuration(val)
+			if err != nil || d < 0 {
+				return fmt.Errorf("broker: %w: wrong tombstone retention %q", ErrInvalidOption, val)
+			}
+			c.TombstoneRetention = d
+		case "acktimeout":
+			d, err := time.ParseDuration(val)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("broker: %w: wrong ack timeout %q", ErrInvalidOption, val)
+			}
+			c.AckTimeout = d
+		case "retrydelay", "retrymaxdelay":
+			d, err := time.ParseDuration(val)
+			if err != nil || d < 0 {
+				return fmt.Errorf("broker: %w: wrong %s %q", ErrInvalidOption, key, val)
+			}
+			if key == "retrydelay" {
+				c.Retry.InitialDelay = d
+			} else {
+				c.Retry.MaxDelay = d
+			}
+		case "retrymultiplier":
+			f, err := strconv.ParseFloat(val, 64)
+			if err != nil || f < 1 {
+				return fmt.Errorf("broker: %w: wrong retry multiplier %q", ErrInvalidOption, val)
+			}
+			c.Retry.Multiplier = f
+		case "retryjitter":
+			f, err := strconv.ParseFloat(val, 64)
+			if err != nil || f < 0 || f > 1 {
+				return fmt.Errorf("broker: %w: wrong retry jitter %q", ErrInvalidOption, val)
+			}
+			c.Retry.Jitter = f
+		default:
+			return fmt.Errorf("broker: %w: unknown topic option %q", ErrInvalidOption, key)
+		}
+	}
+
+	return nil
+}
+
+type Topic struct {
+	name string
+	// queue holds messages published while the topic has no subscribers
+	queue     *Queue
+	groups    []*group
+	Consumers []*Consumer
+	schema    *schema.NodeSchema
+	config    TopicConfig
+	dedup     *dedupWindow
+	// options are all options config was applied with, stored under
+	// configVersion
+	options       map[string]string
+	configVersion uint64
+
+	// refs counts copies of a message which are still queued in the topic
+	// or in groups or unacked, message is acked in storage when it drops to
+	// zero
+	refs map[string]int
+	// holders are names of groups holding copies of messages queued while
+	// the topic had named groups, stored with message as its Groups
+	holders map[string][]string
+	// expired counts message copies which expired before delivery
+	expired int
+	// retained is the last message published with retain flag, every new
+	// consumer gets a copy of it
+	retained *Message
+
+	// log keeps messages of log topics in offset order until retention
+	// removes them
+	log        []Message
+	logBytes   int64
+	lastOffset uint64
+	// committed are stored offsets named groups resume from
+	committed map[string]uint64
+	// logKeys are compaction keys of logged messages by offset, latest is
+	// offset of the newest message of every key. Compaction removes
+	// superseded offsets and expired tombstones.
+	logKeys    map[uint64]string
+	latest     map[string]uint64
+	superseded []uint64
+	tombstones []tombstone
+}
+
+func (t Topic) Name() string {
+	return t.name
+}
+
+func (t Topic) Config() TopicConfig {
+	return t.config
+}
+
+// Expired returns how many message copies expired before delivery.
+func (t Topic) Expired() int {
+	return t.expired
+}
+
+// validatePayload checks payload against topic schema s, if any. Returned
+// error is *schema.ValidationError.
+func validatePayload(s *schema.NodeSchema, payload []byte) error {
+	if s == nil {
+		return nil
+	}
+
+	var data map[string]any
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return &schema.ValidationError{Reason: fmt.Sprintf("payload is not a JSON object: %v", err)}
+	}
+
+	return schema.ValidateMap(*s, data)
+}
+
+func (t *Topic) deadLetterTopic() string {
+	if t.config.DeadLetter != "" {
+		return t.config.DeadLetter
+	}
+
+	return t.name + DeadLetterSuffix
+}
+
+// group is a set of consumers sharing a single queue: every message in the
+// queue is delivered to exactly one of them. Every group of a topic gets its
+// own copy of each message.
+type group struct {
+	// name is set for groups requested by subscribers, such groups outlive
+	// their members and get their copies of unacked messages back after a
+	// restart
+	name      string
+	queue     *Queue
+	consumers []*Consumer
+	// next is the round-robin position in consumers
+	next int
+	// private groups belong to a single fan-out subscriber and are removed
+	// together with it
+	private bool
+	closed  bool
+	// busyKeys counts messages of each ordering key which are in flight or
+	// waiting for redelivery, next message of a busy key waits for them
+	busyKeys map[string]int
+	// outstanding are offsets of log messages queued for the group or in
+	// flight, logNext is the offset after the last queued one
+	outstanding map[uint64]bool
+	logNext     uint64
+}
+
+type delivery struct {
+	consumer *Consumer
+	msg      Message
+}
+
+type Consumer struct {
+	ch       chan Message
+	topic    *Topic
+	group    *group
+	inflight map[string]*Message
+	// pattern is the wildcard subscription consumer was attached by
+	pattern string
+	filter  *filter.Filter
+	// pull consumers get messages only for their pending fetch, push
+	// consumers through their outbox
+	pull  bool
+	fetch *pendingFetch
+	out   *outbox
+	// consumer with prefetch gets messages only while it has credit, every
+	// message taken from inflight returns one
+	prefetch int
+	credit   int
+	// seq counts deliveries of the subscription, consumers a pattern
+	// subscription attached to matching topics share it
+	seq *uint64
+	// retained is copy of topic retained message waiting to be delivered to
+	// this consumer before messages of its group
+	retained *Message
+}
+
+func (c *Consumer) setPrefetch(prefetch int) {
+	c.prefetch = prefetch
+	c.credit = prefetch - len(c.inflight)
+}
+
+// offer hands message to consumer without blocking and reports whether it
+// was taken.
+func (c *Consumer) offer(msg Message) bool {
+	if c.prefetch > 0 && c.credit <= 0 {
+		return false
+	}
+
+	if c.pull {
+		if c.fetch == nil || c.fetch.full() {
+			return false
+		}
+
+		c.fetch.msgs = append(c.fetch.msgs, msg)
+		return true
+	}
+
+	return c.out.put(msg)
+}
+
+// give offers msg to consumer and tracks it as unacked once taken.
+func (c *Consumer) give(msg Message) (Message, bool) {
+	msg.DeliveredAt = time.Now()
+	msg.DeliverySeq = *c.seq + 1
+	if !c.offer(msg) {
+		return msg, false
+	}
+
+	*c.seq++
+	c.track(&msg)
+	return msg, true
+}
+
+// track records message sent to consumer as unacked.
+func (c *Consumer) track(msg *Message) {
+	c.inflight[msg.ID] = msg
+	c.credit--
+	if msg.Key != "" {
+		c.group.busyKeys[msg.Key]++
+	}
+}
+
+// untrack removes unacked message of consumer.
+func (c *Consumer) untrack(msgID string) {
+	msg, ok := c.inflight[msgID]
+	if !ok {
+		return
+	}
+
+	delete(c.inflight, msgID)
+	c.credit++
+	if msg.Key != "" {
+		c.group.unbusy(msg.Key)
+	}
+}
+
+// subject is what consumer subscribed to, topic name or pattern.
+func (c *Consumer) subject() string {
+	if c.pattern != "" {
+		return c.pattern
+	}
+
+	return c.topic.name
+}
+
+// Groups returns names of consumer groups of the topic.
+func (t Topic) Groups() []string {
+	var names []string
+	for _, g := range t.groups {
+		if g.name != "" {
+			names = append(names, g.name)
+		}
+	}
+
+	return names
+}
+
+// addConsumer subscribes ch to the named group, or to the topic itself when
+// groupName is empty. Subscriptions by different patterns are separate
+// consumers. New group of a log topic reads the log from position from.
+func (t *Topic) addConsumer(ch chan Message, groupName, pattern string, from Position) *Consumer {
+	for _, c := range t.Consumers {
+		if c.ch == ch && c.group.name == groupName && c.pattern == pattern {
+			return c
+		}
+	}
+
+	var g *group
+	if groupName != "" || t.config.Delivery != DeliveryFanout {
+		for _, existing := range t.groups {
+			if !existing.private && existing.name == groupName {
+				g = existing
+				break
+			}
+		}
+	}
+
+	if g == nil {
+		g = &group{
+			name:     groupName,
+			queue:    newMessageQueue(),
+			private:  groupName == "" && t.config.Delivery == DeliveryFanout,
+			busyKeys: make(map[string]int),
+		}
+		if t.config.Log {
+			t.replay(g, t.start(g, from))
+		} else {
+			t.takeOver(g)
+		}
+		t.groups = append(t.groups, g)
+	}
+
+	c := &Consumer{ch: ch, topic: t, group: g, pattern: pattern, inflight: make(map[string]*Message)}
+	g.consumers = append(g.consumers, c)
+	t.Consumers = append(t.Consumers, c)
+
+	// every new subscriber learns current state, unless its group is about
+	// to deliver the same message anyway
+	if msg, ok := t.retainedCopy(time.Now()); ok && !g.holds(msg.ID) {
+		c.retained = &msg
+		t.refs[msg.ID]++
+	}
+
+	return c
+}
+
+// takeOver queues messages for new group g, the first group takes over
+// everything waiting in the topic for a subscriber.
+func (t *Topic) takeOver(g *group) {
+	for !t.queue.Empty() {
+		item, _ := t.queue.Dequeue()
+		msg := item.(Message)
+		msg.group = g.name
+		g.queue.Enqueue(msg)
+
+		// copy kept for groups without a name now belongs to g
+		if i := slices.Index(t.holders[msg.ID], ""); i >= 0 {
+			t.holders[msg.ID][i] = g.name
+		}
+	}
+}
+
+// restore queues recovered message for groups named in its Groups, creating
+// named groups without members. Message stored without them, or held by a
+// group without a name, waits in the topic queue.
+func (t *Topic) restore(msg Message) {
+	if len(msg.Groups) == 0 {
+		t.queue.Enqueue(msg)
+		t.refs[msg.ID]++
+		return
+	}
+
+	var holders []string
+	for _, name := range msg.Groups {
+		if name == "" {
+			if !slices.Contains(holders, "") {
+				t.queue.Enqueue(msg)
+				t.refs[msg.ID]++
+				holders = append(holders, "")
+			}
+			continue
+		}
+
+		i := slices.IndexFunc(t.groups, func(g *group) bool {
+			return !g.private && g.name == name
+		})
+		if i < 0 {
+			t.groups = append(t.groups, &group{name: name, queue: newMessageQueue(), busyKeys: make(map[string]int)})
+			i = len(t.groups) - 1
+		}
+		t.groups[i].push(msg)
+		t.refs[msg.ID]++
+		holders = append(holders, name)
+	}
+	t.holders[msg.ID] = holders
+}
+
+// groupNames returns names of groups every message queued now gets a copy
+// for. It is nil unless some of them are named, messages of other topics go
+// to the first subscriber after a restart.
+func (t *Topic) groupNames() []string {
+	if t.config.Log || !slices.ContainsFunc(t.groups, func(g *group) bool { return g.name != "" }) {
+		return nil
+	}
+
+	names := make([]string, 0, len(t.groups))
+	for _, g := range t.groups {
+		names = append(names, g.name)
+	}
+
+	return names
+}
+
+// dropHolder forgets group of released copy of msg and reports whether the
+// group no longer holds any copy, so the stored record must change.
+func (t *Topic) dropHolder(msg Message) bool {
+	holders, ok := t.holders[msg.ID]
+	if !ok {
+		return false
+	}
+
+	i := slices.Index(holders, msg.group)
+	if i < 0 {
+		return false
+	}
+	holders = slices.Delete(holders, i, i+1)
+	t.holders[msg.ID] = holders
+
+	return !slices.Contains(holders, msg.group)
+}
+
+// removeConsumer detaches c from the topic. It returns messages c has not
+// acked and, if c was the only member of a private group, messages still
+// queued for that group. When that group was the last one, its messages go
+// back to the topic queue for the next subscriber instead.
+func (t *Topic) removeConsumer(c *Consumer) (inflight, dropped []Message) {
+	t.Consumers = removeItem(t.Consumers, c)
+
+	g := c.group
+	g.consumers = removeItem(g.consumers, c)
+
+	for id, msg := range c.inflight {
+		inflight = append(inflight, *msg)
+		c.untrack(id)
+	}
+	if c.retained != nil {
+		dropped = append(dropped, *c.retained)
+		c.retained = nil
+	}
+
+	if g.private {
+		t.groups = removeItem(t.groups, g)
+		g.closed = true
+
+		if len(t.groups) > 0 || t.config.Log {
+			for !g.queue.Empty() {
+				msg, _ := g.queue.Dequeue()
+				dropped = append(dropped, msg.(Message))
+			}
+			return inflight, dropped
+		}
+
+		// unacked messages were delivered before the queued ones
+		slices.SortFunc(inflight, func(a, b Message) int {
+			return cmp.Compare(a.DeliverySeq, b.DeliverySeq)
+		})
+		for _, msg := range inflight {
+			t.queue.Enqueue(msg)
+		}
+		for !g.queue.Empty() {
+			msg, _ := g.queue.Dequeue()
+			t.queue.Enqueue(msg)
+		}
+		inflight = nil
+	}
+
+	return inflight, dropped
+}
+
+func (t *Topic) enqueue(msg Message) {
+	if len(t.groups) == 0 {
+		// log keeps messages for groups created later
+		if !t.config.Log {
+			msg.group = ""
+			t.queue.Enqueue(msg)
+			t.refs[msg.ID]++
+		}
+		return
+	}
+
+	for _, g := range t.groups {
+		g.push(msg)
+		t.refs[msg.ID]++
+	}
+	if names := t.groupNames(); names != nil {
+		t.holders[msg.ID] = names
+	}
+}
+
+// release drops one copy of a message and reports whether it was the last.
+func (t *Topic) release(msgID string) bool {
+	t.refs[msgID]--
+	if t.refs[msgID] > 0 {
+		return false
+	}
+
+	delete(t.refs, msgID)
+	delete(t.holders, msgID)
+	return true
+}
+
+// deliver sends queued messages to consumers. Dropped are copies which
+// expired or no consumer of their group wants, they are removed from the
+// group.
+func (t *Topic) deliver(now time.Time) (delivered []delivery, dropped []Message) {
+	for _, g := range t.groups {
+		delivered, dropped = g.deliver(g.mode(t.config.Delivery), now, delivered, dropped)
+	}
+
+	return delivered, dropped
+}
+
+// removeExpired removes expired messages waiting for subscribers or queued in
+// groups.
+func (t *Topic) removeExpired(now time.Time) []Message {
+	isExpired := func(item any) bool {
+		return item.(Message).expired(now)
+	}
+
+	var removed []Message
+	for _, item := range t.queue.RemoveFunc(isExpired) {
+		removed = append(removed, item.(Message))
+	}
+	for _, g := range t.groups {
+		for _, item := range g.queue.RemoveFunc(isExpired) {
+			g.done(item.(Message))
+			removed = append(removed, item.(Message))
+		}
+	}
+
+	return removed
+}
+
+// mode returns how messages are spread between group members. Named groups
+// always share messages, even on fan-out topics.
+func (g *group) mode(topicMode DeliveryMode) DeliveryMode {
+	if topicMode == DeliveryFanout {
+		return DeliveryRoundRobin
+	}
+
+	return topicMode
+}
+
+func (g *group) deliver(mode DeliveryMode, now time.Time, delivered []delivery, dropped []Message) ([]delivery, []Message) {
+	if len(g.consumers) == 0 {
+		return delivered, dropped
+	}
+
+	for _, c := range g.consumers {
+		if c.retained == nil {
+			continue
+		}
+
+		msg := *c.retained
+		if msg.expired(now) || !containsItem(g.matching(msg.Payload), c) {
+			c.retained = nil
+			dropped = append(dropped, msg)
+			continue
+		}
+
+		msg.Attempts++
+		if sent, ok := c.give(msg); ok {
+			c.retained = nil
+			delivered = append(delivered, delivery{consumer: c, msg: sent})
+		}
+	}
+
+	// blocked keys can not be delivered in this pass, their later messages
+	// are skipped to keep them in order
+	blocked := make(map[string]bool)
+	g.queue.Scan(func(item any) (bool, bool) {
+		msg := item.(Message)
+		if msg.expired(now) {
+			g.done(msg)
+			dropped = append(dropped, msg)
+			return true, false
+		}
+
+		if msg.Key != "" && (blocked[msg.Key] || g.busyKeys[msg.Key] > 0) {
+			blocked[msg.Key] = true
+			return false, false
+		}
+
+		c, sent, wanted := g.send(mode, msg)
+		if !wanted {
+			g.done(msg)
+			dropped = append(dropped, msg)
+			return true, false
+		}
+
+		if c == nil {
+			if msg.Key == "" {
+				// every consumer is busy, try again on next delivery signal
+				return false, true
+			}
+
+			blocked[msg.Key] = true
+			return false, false
+		}
+
+		delivered = append(delivered, delivery{consumer: c, msg: sent})
+		return true, false
+	})
+
+	return delivered, dropped
+}
+
+// requeue returns message to the queue. Keyed message goes to the front so
+// it is not overtaken by later messages with the same key.
+func (g *group) requeue(msg Message) {
+	if msg.Key != "" {
+		g.queue.PushFront(msg)
+		return
+	}
+
+	g.queue.Enqueue(msg)
+}
+
+func (g *group) unbusy(key string) {
+	g.busyKeys[key]--
+	if g.busyKeys[key] <= 0 {
+		delete(g.busyKeys, key)
+	}
+}
+
+// send offers msg to consumers whose filter it matches. wanted is false when
+// there are no such consumers.
+func (g *group) send(mode DeliveryMode, msg Message) (*Consumer, Message, bool) {
+	matching := g.matching(msg.Payload)
+	if len(matching) == 0 {
+		return nil, msg, false
+	}
+
+	msg.Attempts++
+	for _, c := range g.candidates(mode, msg.Key, matching) {
+		if sent, ok := c.give(msg); ok {
+			return c, sent, true
+		}
+	}
+
+	return nil, msg, true
+}
+
+// holds reports whether message is queued, in flight or waiting as retained
+// copy in the group.
+func (g *group) holds(msgID string) bool {
+	found := false
+	g.queue.Scan(func(item any) (bool, bool) {
+		found = item.(Message).ID == msgID
+		return false, found
+	})
+
+	for _, c := range g.consumers {
+		if _, ok := c.inflight[msgID]; ok || (c.retained != nil && c.retained.ID == msgID) {
+			found = true
+		}
+	}
+
+	return found
+}
+
+// matching returns consumers whose filter matches payload in group order.
+// Payload is decoded once for all filters, payloads which are not JSON
+// objects match none.
+func (g *group) matching(payload []byte) []*Consumer {
+	var (
+		data    map[string]any
+		decoded bool
+		dataErr error
+		matched []*Consumer
+	)
+
+	for _, c := range g.consumers {
+		if c.filter != nil {
+			if !decoded {
+				dataErr = json.Unmarshal(payload, &data)
+				decoded = true
+			}
+			if dataErr != nil || !c.filter.Match(data) {
+				continue
+			}
+		}
+		matched = append(matched, c)
+	}
+
+	return matched
+}
+
+// candidates returns matching consumers in the order they should be offered
+// the next message. Keyed message has a single candidate picked by hash of
+// its key among matching consumers, so a key sticks to a consumer while
+// group members do not change.
+func (g *group) candidates(mode DeliveryMode, key string, matching []*Consumer) []*Consumer {
+	n := len(matching)
+	if key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return []*Consumer{matching[h.Sum32()%uint32(n)]}
+	}
+
+	start := g.next % n
+	g.next = (start + 1) % n
+
+	ordered := make([]*Consumer, 0, n)
+	ordered = append(ordered, matching[start:]...)
+	ordered = append(ordered, matching[:start]...)
+
+	if mode == DeliveryLeastLoaded {
+		// stable sort keeps round-robin order between equally loaded consumers
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return len(ordered[i].inflight) < len(ordered[j].inflight)
+		})
+	}
+
+	return ordered
+}
+
+func containsItem[T comparable](items []T, item T) bool {
+	for _, v := range items {
+		if v == item {
+			return true
+		}
+	}
+
+	return false
+}
+
+func removeItem[T comparable](items []T, item T) []T {
+	for i, v := range items {
+		if v == item {
+			return append(items[:i], items[i+1:]...)
+		}
+	}
+
+	return items
+}
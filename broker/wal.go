@@ -0,0 +1,502 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type FsyncPolicy int
+
+const (
+	// FsyncNever leaves flushing to the operating system.
+	FsyncNever FsyncPolicy = iota
+	// FsyncAlways syncs the segment after every written record.
+	FsyncAlways
+	// FsyncInterval syncs dirty segments every LogConfig.FsyncInterval.
+	FsyncInterval
+)
+
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch s {
+	case "never":
+		return FsyncNever, nil
+	case "always":
+		return FsyncAlways, nil
+	case "interval":
+		return FsyncInterval, nil
+	}
+
+	return 0, fmt.Errorf("wal: unknown fsync policy %q", s)
+}
+
+const (
+	defaultSegmentSize   = 64 << 20
+	defaultFsyncInterval = time.Second
+
+	segmentExt = ".log"
+	// frame header is record length followed by crc32 of record
+	frameHeaderSize = 8
+)
+
+var ErrCorruptLog = errors.New("wal: corrupt log")
+
+type LogConfig struct {
+	Dir           string
+	SegmentSize   int64
+	Fsync         FsyncPolicy
+	FsyncInterval time.Duration
+}
+
+const (
+	opPublish = "pub"
+	opAck     = "ack"
+)
+
+type record struct {
+	Op  string   `json:"op"`
+	Msg *Message `json:"msg,omitempty"`
+	ID  string   `json:"id,omitempty"`
+}
+
+type segment struct {
+	seq  uint64
+	path string
+	// live is the number of messages published in this segment and not acked yet
+	live int
+}
+
+type topicLog struct {
+	dir      string
+	segments []*segment
+	active   *os.File
+	size     int64
+	dirty    bool
+	owner    map[string]*segment
+
+	recovered []Message
+}
+
+// LogStorage is an append-only segmented log with one directory per topic.
+// Segments are removed once every message published in them is acked.
+type LogStorage struct {
+	mu     sync.Mutex
+	cfg    LogConfig
+	topics map[string]*topicLog
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+func NewLogStorage(cfg LogConfig) (*LogStorage, error) {
+	if cfg.SegmentSize <= 0 {
+		cfg.SegmentSize = defaultSegmentSize
+	}
+	if cfg.FsyncInterval <= 0 {
+		cfg.FsyncInterval = defaultFsyncInterval
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("wal: create dir: %w", err)
+	}
+
+	s := &LogStorage{
+		cfg:    cfg,
+		topics: make(map[string]*topicLog),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("wal: read dir: %w", err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		topic, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		tl, err := openTopicLog(filepath.Join(cfg.Dir, entry.Name()))
+		if err != nil {
+			s.closeLogs()
+			return nil, fmt.Errorf("wal: open topic %q: %w", topic, err)
+		}
+		s.topics[topic] = tl
+	}
+
+	go s.syncLoop()
+
+	return s, nil
+}
+
+func (s *LogStorage) Append(msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tl, err := s.topicLog(msg.Topic)
+	if err != nil {
+		return err
+	}
+
+	seg, err := tl.write(record{Op: opPublish, Msg: &msg}, s.cfg)
+	if err != nil {
+		return err
+	}
+
+	if prev, ok := tl.owner[msg.ID]; ok {
+		prev.live--
+	}
+	seg.live++
+	tl.owner[msg.ID] = seg
+
+	return nil
+}
+
+func (s *LogStorage) Ack(topic, msgID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tl, ok := s.topics[topic]
+	if !ok {
+		return nil
+	}
+
+	seg, ok := tl.owner[msgID]
+	if !ok {
+		return nil
+	}
+
+	if _, err := tl.write(record{Op: opAck, ID: msgID}, s.cfg); err != nil {
+		return err
+	}
+
+	delete(tl.owner, msgID)
+	seg.live--
+
+	return tl.removeAcked()
+}
+
+func (s *LogStorage) Load() ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var msgs []Message
+	for _, tl := range s.topics {
+		msgs = append(msgs, tl.recovered...)
+		tl.recovered = nil
+	}
+
+	return msgs, nil
+}
+
+func (s *LogStorage) Close() error {
+	close(s.quit)
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closeLogs()
+}
+
+func (s *LogStorage) closeLogs() error {
+	var errs []error
+	for _, tl := range s.topics {
+		if tl.active == nil {
+			continue
+		}
+
+		errs = append(errs, tl.active.Sync(), tl.active.Close())
+		tl.active = nil
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *LogStorage) syncLoop() {
+	defer close(s.done)
+
+	if s.cfg.Fsync != FsyncInterval {
+		<-s.quit
+		return
+	}
+
+	ticker := time.NewTicker(s.cfg.FsyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			for _, tl := range s.topics {
+				if err := tl.sync(); err != nil {
+					// next write or tick retries the sync
+					tl.dirty = true
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *LogStorage) topicLog(topic string) (*topicLog, error) {
+	if tl, ok := s.topics[topic]; ok {
+		return tl, nil
+	}
+
+	dir := filepath.Join(s.cfg.Dir, url.PathEscape(topic))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("wal: create topic dir: %w", err)
+	}
+
+	tl, err := openTopicLog(dir)
+	if err != nil {
+		return nil, err
+	}
+	s.topics[topic] = tl
+
+	return tl, nil
+}
+
+func openTopicLog(dir string) (*topicLog, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	tl := &topicLog{dir: dir, owner: make(map[string]*segment)}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		tl.segments = append(tl.segments, &segment{seq: seq, path: filepath.Join(dir, name)})
+	}
+	sort.Slice(tl.segments, func(i, j int) bool { return tl.segments[i].seq < tl.segments[j].seq })
+
+	var order []string
+	pending := make(map[string]Message)
+	for i, seg := range tl.segments {
+		last := i == len(tl.segments)-1
+
+		valid, err := readSegment(seg.path, func(rec record) {
+			switch rec.Op {
+			case opPublish:
+				if rec.Msg == nil {
+					return
+				}
+				if prev, exists := tl.owner[rec.Msg.ID]; exists {
+					prev.live--
+				} else {
+					order = append(order, rec.Msg.ID)
+				}
+				pending[rec.Msg.ID] = *rec.Msg
+				tl.owner[rec.Msg.ID] = seg
+				seg.live++
+			case opAck:
+				if owner, ok := tl.owner[rec.ID]; ok {
+					owner.live--
+					delete(tl.owner, rec.ID)
+					delete(pending, rec.ID)
+				}
+			}
+		})
+		if err != nil {
+			// torn write at the tail of the newest segment is expected after a crash
+			if !last || !errors.Is(err, ErrCorruptLog) {
+				return nil, fmt.Errorf("segment %s: %w", seg.path, err)
+			}
+
+			if err := os.Truncate(seg.path, valid); err != nil {
+				return nil, fmt.Errorf("truncate segment %s: %w", seg.path, err)
+			}
+		}
+	}
+
+	for _, id := range order {
+		if msg, ok := pending[id]; ok {
+			tl.recovered = append(tl.recovered, msg)
+			delete(pending, id)
+		}
+	}
+
+	if len(tl.segments) == 0 {
+		if err := tl.roll(); err != nil {
+			return nil, err
+		}
+	} else {
+		seg := tl.segments[len(tl.segments)-1]
+		f, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		tl.active = f
+		tl.size = info.Size()
+	}
+
+	if err := tl.removeAcked(); err != nil {
+		return nil, err
+	}
+
+	return tl, nil
+}
+
+func readSegment(path string, fn func(record)) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header := make([]byte, frameHeaderSize)
+
+	var valid int64
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return valid, nil
+			}
+			return valid, ErrCorruptLog
+		}
+
+		size := binary.BigEndian.Uint32(header[:4])
+		sum := binary.BigEndian.Uint32(header[4:])
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return valid, ErrCorruptLog
+		}
+
+		if crc32.ChecksumIEEE(data) != sum {
+			return valid, ErrCorruptLog
+		}
+
+		var rec record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return valid, ErrCorruptLog
+		}
+
+		fn(rec)
+		valid += int64(frameHeaderSize + len(data))
+	}
+}
+
+func (tl *topicLog) write(rec record, cfg LogConfig) (*segment, error) {
+	if tl.size >= cfg.SegmentSize {
+		if err := tl.roll(); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("wal: marshal record: %w", err)
+	}
+
+	frame := make([]byte, frameHeaderSize+len(data))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(data))
+	copy(frame[frameHeaderSize:], data)
+
+	n, err := tl.active.Write(frame)
+	tl.size += int64(n)
+	if err != nil {
+		return nil, fmt.Errorf("wal: write record: %w", err)
+	}
+
+	if cfg.Fsync == FsyncAlways {
+		if err := tl.active.Sync(); err != nil {
+			return nil, fmt.Errorf("wal: sync segment: %w", err)
+		}
+	} else {
+		tl.dirty = true
+	}
+
+	return tl.segments[len(tl.segments)-1], nil
+}
+
+func (tl *topicLog) roll() error {
+	var seq uint64
+	if len(tl.segments) > 0 {
+		seq = tl.segments[len(tl.segments)-1].seq + 1
+	}
+
+	if tl.active != nil {
+		if err := tl.active.Sync(); err != nil {
+			return fmt.Errorf("wal: sync segment: %w", err)
+		}
+		if err := tl.active.Close(); err != nil {
+			return fmt.Errorf("wal: close segment: %w", err)
+		}
+	}
+
+	path := filepath.Join(tl.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("wal: create segment: %w", err)
+	}
+
+	tl.segments = append(tl.segments, &segment{seq: seq, path: path})
+	tl.active = f
+	tl.size = 0
+	tl.dirty = false
+
+	return nil
+}
+
+func (tl *topicLog) sync() error {
+	if !tl.dirty || tl.active == nil {
+		return nil
+	}
+
+	tl.dirty = false
+	return tl.active.Sync()
+}
+
+// removeAcked deletes the oldest segments while all of their messages are
+// acked. Acks always follow their publish, so dropping such a prefix never
+// resurrects a message on replay.
+func (tl *topicLog) removeAcked() error {
+	for len(tl.segments) > 1 && tl.segments[0].live == 0 {
+		if err := os.Remove(tl.segments[0].path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("wal: remove segment: %w", err)
+		}
+		tl.segments = tl.segments[1:]
+	}
+
+	return nil
+}
@@ -0,0 +1,454 @@
+package broker_test
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vlaner/postal/broker"
+)
+
+func newTestLogStorage(t *testing.T, cfg broker.LogConfig) *broker.LogStorage {
+	s, err := broker.NewLogStorage(cfg)
+	if err != nil {
+		t.Fatalf("unexpected new log storage error: %v", err)
+	}
+
+	return s
+}
+
+func TestLogStorageRecover(t *testing.T) {
+	cfg := broker.LogConfig{Dir: t.TempDir(), Fsync: broker.FsyncAlways}
+	s := newTestLogStorage(t, cfg)
+
+	for _, id := range []string{"1", "2", "3"} {
+		if err := s.Append(broker.NewMessage(id, "test", []byte(id))); err != nil {
+			t.Fatalf("unexpected append error: %v", err)
+		}
+	}
+
+	if err := s.Ack("test", "2"); err != nil {
+		t.Fatalf("unexpected ack error: %v", err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected close error: %v", err)
+	}
+
+	s = newTestLogStorage(t, cfg)
+	defer s.Close()
+
+	msgs, err := s.Load()
+	if err != nil {
+		t.Fatalf("unexpected load error: %v", err)
+	}
+
+	if len(msgs) != 2 {
+		t.Fatalf("got wrong recovered length: expected 2 got %d", len(msgs))
+	}
+
+	if msgs[0].ID != "1" || msgs[1].ID != "3" {
+		t.Errorf("got wrong recovered order: %s, %s", msgs[0].ID, msgs[1].ID)
+	}
+
+	if !bytes.Equal(msgs[1].Payload, []byte("3")) {
+		t.Errorf("got wrong payload: expected %q got %q", "3", msgs[1].Payload)
+	}
+}
+
+func TestLogStorageTornWrite(t *testing.T) {
+	cfg := broker.LogConfig{Dir: t.TempDir()}
+	s := newTestLogStorage(t, cfg)
+
+	if err := s.Append(broker.NewMessage("1", "test", []byte("data"))); err != nil {
+		t.Fatalf("unexpected append error: %v", err)
+	}
+	s.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(cfg.Dir, "test", "*.log"))
+	if len(segments) != 1 {
+		t.Fatalf("got wrong segment count: expected 1 got %d", len(segments))
+	}
+
+	f, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 1, 2})
+	f.Close()
+
+	s = newTestLogStorage(t, cfg)
+	msgs, _ := s.Load()
+	if len(msgs) != 1 {
+		t.Fatalf("got wrong recovered length: expected 1 got %d", len(msgs))
+	}
+
+	if err := s.Append(broker.NewMessage("2", "test", []byte("data"))); err != nil {
+		t.Fatalf("unexpected append error: %v", err)
+	}
+	s.Close()
+
+	s = newTestLogStorage(t, cfg)
+	defer s.Close()
+
+	msgs, _ = s.Load()
+	if len(msgs) != 2 {
+		t.Errorf("got wrong recovered length after torn write: expected 2 got %d", len(msgs))
+	}
+}
+
+func TestLogStorageRemovesAckedSegments(t *testing.T) {
+	cfg := broker.LogConfig{Dir: t.TempDir(), SegmentSize: 128}
+	s := newTestLogStorage(t, cfg)
+	defer s.Close()
+
+	ids := []string{"1", "2", "3", "4", "5", "6"}
+	for _, id := range ids {
+		s.Append(broker.NewMessage(id, "test", bytes.Repeat([]byte("x"), 64)))
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(cfg.Dir, "test", "*.log"))
+	if len(segments) < 2 {
+		t.Fatalf("expected log to be segmented, got %d segments", len(segments))
+	}
+
+	for _, id := range ids {
+		s.Ack("test", id)
+	}
+
+	segments, _ = filepath.Glob(filepath.Join(cfg.Dir, "test", "*.log"))
+	if len(segments) != 1 {
+		t.Errorf("got wrong segment count after ack: expected 1 got %d", len(segments))
+	}
+}
+
+func TestBrokerRecoversUnacked(t *testing.T) {
+	cfg := broker.LogConfig{Dir: t.TempDir()}
+
+	b := newTestBroker(t, broker.WithStorage(newTestLogStorage(t, cfg)))
+	b.Publish(broker.NewMessage("test", "test", []byte("testpayload")))
+	if err := b.Stop(); err != nil {
+		t.Fatalf("unexpected stop error: %v", err)
+	}
+
+	b = newTestBroker(t, broker.WithStorage(newTestLogStorage(t, cfg)))
+	defer b.Stop()
+
+	tc := newTestPubSub(t, b)
+	tc.subscribe("test")
+
+	got := tc.readMessage()
+	if got.ID != "test" || !bytes.Equal(got.Payload, []byte("testpayload")) {
+		t.Errorf("got wrong recovered message %+v", got)
+	}
+}
+
+func TestBrokerRecoversDelayed(t *testing.T) {
+	cfg := broker.LogConfig{Dir: t.TempDir()}
+
+	b := newTestBroker(t, broker.WithStorage(newTestLogStorage(t, cfg)))
+	msg := broker.NewMessage("test", "test", []byte("testpayload"))
+	msg.NotBefore = time.Now().Add(200 * time.Millisecond)
+	b.Publish(msg)
+	if err := b.Stop(); err != nil {
+		t.Fatalf("unexpected stop error: %v", err)
+	}
+
+	b = newTestBroker(t, broker.WithStorage(newTestLogStorage(t, cfg)))
+	defer b.Stop()
+
+	tc := newTestPubSub(t, b)
+	tc.subscribe("test")
+
+	got := tc.readMessage()
+	if got.ID != "test" || got.DeliveredAt.Before(msg.NotBefore) {
+		t.Errorf("got wrong recovered delayed message %+v", got)
+	}
+}
+
+func TestBrokerRecoversRetained(t *testing.T) {
+	cfg := broker.LogConfig{Dir: t.TempDir()}
+
+	b := newTestBroker(t, broker.WithStorage(newTestLogStorage(t, cfg)))
+	tc := newTestPubSub(t, b)
+	tc.subscribe("test")
+
+	msg := broker.NewMessage("test", "test", []byte("testpayload"))
+	msg.Retain = true
+	b.Publish(msg)
+	b.Ack(tc.ch, tc.readMessage().ID)
+	if err := b.Stop(); err != nil {
+		t.Fatalf("unexpected stop error: %v", err)
+	}
+
+	b = newTestBroker(t, broker.WithStorage(newTestLogStorage(t, cfg)))
+	defer b.Stop()
+
+	tc = newTestPubSub(t, b)
+	tc.subscribe("test")
+	if got := tc.readMessage(); got.ID != "test" || !got.Retain {
+		t.Errorf("got wrong recovered retained message %+v", got)
+	}
+}
+
+func TestBrokerRecoversLogOffsets(t *testing.T) {
+	cfg := broker.LogConfig{Dir: t.TempDir()}
+
+	b := newTestBroker(t, broker.WithStorage(newTestLogStorage(t, cfg)))
+	if err := b.ConfigureTopic("events", map[string]string{"log": "true"}); err != nil {
+		t.Fatalf("unexpected configure error: %v", err)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		b.Publish(broker.NewMessage(id, "events", []byte(id)))
+	}
+
+	from, _ := broker.ParsePosition("earliest")
+	tc := newTestPubSub(t, b)
+	b.Register(broker.SubscribeRequest{Topic: "events", Group: "indexer", ConsumeCh: tc.ch, From: from})
+	for range 2 {
+		b.Ack(tc.ch, tc.readMessage().ID)
+	}
+	if err := b.Stop(); err != nil {
+		t.Fatalf("unexpected stop error: %v", err)
+	}
+
+	b = newTestBroker(t, broker.WithStorage(newTestLogStorage(t, cfg)))
+	defer b.Stop()
+
+	// named group resumes after acked messages, others can replay everything
+	tc = newTestPubSub(t, b)
+	tc.subscribeGroup("events", "indexer")
+	if got := tc.readMessage(); got.ID != "3" || got.Offset != 3 {
+		t.Errorf("expected group to resume at offset 3, got %s at offset %d", got.ID, got.Offset)
+	}
+
+	replay := newTestPubSub(t, b)
+	b.Register(broker.SubscribeRequest{Topic: "events", ConsumeCh: replay.ch, From: from})
+	if got := replay.readMessage(); got.ID != "1" {
+		t.Errorf("expected replay from recovered log, got %s", got.ID)
+	}
+}
+
+func TestBrokerRecoversAttempts(t *testing.T) {
+	cfg := broker.LogConfig{Dir: t.TempDir()}
+	opts := map[string]string{"maxdeliveries": "2"}
+
+	b := newTestBroker(t, broker.WithStorage(newTestLogStorage(t, cfg)))
+	b.ConfigureTopic("test", opts)
+	tc := newTestPubSub(t, b)
+	tc.subscribe("test")
+	tc.publish(broker.NewMessage("test", "test", []byte("testpayload")))
+
+	b.Nack(broker.NackRequest{ConsumeCh: tc.ch, MessageID: tc.readMessage().ID})
+	// broker stops while second delivery is unacked
+	tc.readMessage()
+	if err := b.Stop(); err != nil {
+		t.Fatalf("unexpected stop error: %v", err)
+	}
+
+	b = newTestBroker(t, broker.WithStorage(newTestLogStorage(t, cfg)))
+	defer b.Stop()
+	b.ConfigureTopic("test", opts)
+
+	dead := newTestPubSub(t, b)
+	dead.subscribe("test" + broker.DeadLetterSuffix)
+	tc = newTestPubSub(t, b)
+	tc.subscribe("test")
+
+	got := tc.readMessage()
+	if got.Attempts != 2 {
+		t.Fatalf("expected attempts to survive restart, got %d", got.Attempts)
+	}
+
+	b.Nack(broker.NackRequest{ConsumeCh: tc.ch, MessageID: got.ID})
+	if got := dead.readMessage(); got.ID != "test" || got.OriginAttempts != 2 {
+		t.Errorf("got wrong dead-lettered message %+v", got)
+	}
+}
+
+func TestBrokerRecoversTopicConfig(t *testing.T) {
+	cfg := broker.LogConfig{Dir: t.TempDir()}
+
+	b := newTestBroker(t, broker.WithStorage(newTestLogStorage(t, cfg)))
+	b.ConfigureTopic("events", map[string]string{"log": "true", "retention": "1h"})
+	b.ConfigureTopic("events", map[string]string{"retentionbytes": "1024"})
+	b.Publish(broker.NewMessage("1", "events", []byte("1")))
+	if err := b.Stop(); err != nil {
+		t.Fatalf("unexpected stop error: %v", err)
+	}
+
+	b = newTestBroker(t, broker.WithStorage(newTestLogStorage(t, cfg)))
+	defer b.Stop()
+
+	for _, topic := range b.Topics() {
+		if topic.Name() != "events" {
+			continue
+		}
+
+		got := topic.Config()
+		if !got.Log || got.Retention != time.Hour || got.RetentionBytes != 1024 {
+			t.Errorf("got wrong recovered config %+v", got)
+		}
+	}
+
+	from, _ := broker.ParsePosition("earliest")
+	tc := newTestPubSub(t, b)
+	b.Register(broker.SubscribeRequest{Topic: "events", ConsumeCh: tc.ch, From: from})
+	if got := tc.readMessage(); got.ID != "1" || got.Offset != 1 {
+		t.Errorf("expected replay of logged message, got %s at offset %d", got.ID, got.Offset)
+	}
+}
+
+func TestBrokerReclaimsOffsetRecords(t *testing.T) {
+	cfg := broker.LogConfig{Dir: t.TempDir(), SegmentSize: 128}
+
+	b := newTestBroker(t, broker.WithStorage(newTestLogStorage(t, cfg)), broker.WithSweepInterval(10*time.Millisecond))
+	defer b.Stop()
+	b.ConfigureTopic("events", map[string]string{"log": "true"})
+	tc := newTestPubSub(t, b)
+	tc.subscribeGroup("events", "indexer")
+	for _, id := range []string{"1", "2", "3"} {
+		b.Publish(broker.NewMessage(id, "events", []byte(id)))
+	}
+
+	for range 3 {
+		b.Ack(tc.ch, tc.readMessage().ID)
+		// offsets are committed by the sweeper
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	dir := filepath.Join(cfg.Dir, url.PathEscape("events"+broker.OffsetsSuffix))
+	if segments, _ := filepath.Glob(filepath.Join(dir, "*.log")); len(segments) > 2 {
+		t.Errorf("expected superseded offsets to be removed, got %d segments", len(segments))
+	}
+}
+
+func TestBrokerRecoversCompaction(t *testing.T) {
+	cfg := broker.LogConfig{Dir: t.TempDir()}
+
+	b := newTestBroker(t, broker.WithStorage(newTestLogStorage(t, cfg)))
+	b.ConfigureTopic("accounts", map[string]string{"log": "true", "compact": "key", "tombstoneretention": "1m"})
+	for _, id := range []string{"a1", "a2"} {
+		msg := broker.NewMessage(id, "accounts", []byte(id))
+		msg.Key = "a"
+		b.Publish(msg)
+	}
+	if err := b.Stop(); err != nil {
+		t.Fatalf("unexpected stop error: %v", err)
+	}
+
+	b = newTestBroker(t, broker.WithStorage(newTestLogStorage(t, cfg)), broker.WithSweepInterval(10*time.Millisecond))
+	defer b.Stop()
+
+	want, _ := broker.ParseCompactKey("key")
+	for _, topic := range b.Topics() {
+		if got := topic.Config(); topic.Name() == "accounts" && (got.Compact != want || got.TombstoneRetention != time.Minute) {
+			t.Errorf("got wrong recovered compaction policy %+v", got)
+		}
+	}
+
+	// compaction is run by the sweeper
+	time.Sleep(100 * time.Millisecond)
+
+	from, _ := broker.ParsePosition("earliest")
+	tc := newTestPubSub(t, b)
+	b.Register(broker.SubscribeRequest{Topic: "accounts", ConsumeCh: tc.ch, From: from})
+	if got := tc.readMessage(); got.ID != "a2" {
+		t.Errorf("expected only latest message of key after restart, got %s", got.ID)
+	}
+}
+
+func TestBrokerRejectsInternalTopics(t *testing.T) {
+	cfg := broker.LogConfig{Dir: t.TempDir()}
+
+	b := newTestBroker(t, broker.WithStorage(newTestLogStorage(t, cfg)))
+	for _, suffix := range []string{broker.RetainedSuffix, broker.OffsetsSuffix, broker.ConfigSuffix} {
+		if _, err := b.Publish(broker.NewMessage("", "foo"+suffix, []byte("{}"))); !errors.Is(err, broker.ErrInvalidTopic) {
+			t.Errorf("expected invalid topic error publishing to %q, got %v", "foo"+suffix, err)
+		}
+		if err := b.ConfigureTopic("foo"+suffix, map[string]string{"ttl": "1s"}); !errors.Is(err, broker.ErrInvalidTopic) {
+			t.Errorf("expected invalid topic error configuring %q, got %v", "foo"+suffix, err)
+		}
+	}
+	if err := b.ConfigureTopic("foo", map[string]string{"deadletter": "foo" + broker.ConfigSuffix}); !errors.Is(err, broker.ErrInvalidOption) {
+		t.Errorf("expected invalid option error dead-lettering to internal topic, got %v", err)
+	}
+	if err := b.Stop(); err != nil {
+		t.Fatalf("unexpected stop error: %v", err)
+	}
+
+	// broker starts again with nothing stored under internal names
+	b = newTestBroker(t, broker.WithStorage(newTestLogStorage(t, cfg)))
+	b.Stop()
+}
+
+func TestBrokerSkipsInboxStorage(t *testing.T) {
+	cfg := broker.LogConfig{Dir: t.TempDir()}
+
+	b := newTestBroker(t, broker.WithStorage(newTestLogStorage(t, cfg)))
+	defer b.Stop()
+
+	inbox, err := broker.NewInbox()
+	if err != nil {
+		t.Fatalf("unexpected new inbox error: %v", err)
+	}
+	tc := newTestPubSub(t, b)
+	tc.subscribe(inbox)
+	tc.publish(broker.NewMessage("", inbox, []byte("reply")))
+	b.Ack(tc.ch, tc.readMessage().ID)
+	b.Unsubscribe(broker.SubscribeRequest{Topic: inbox, ConsumeCh: tc.ch})
+
+	if dirs, _ := filepath.Glob(filepath.Join(cfg.Dir, url.PathEscape(broker.InboxPrefix)+"*")); len(dirs) != 0 {
+		t.Errorf("expected no storage logs of inbox topics, got %v", dirs)
+	}
+}
+
+func TestBrokerRecoversGroupCopies(t *testing.T) {
+	cfg := broker.LogConfig{Dir: t.TempDir()}
+
+	b := newTestBroker(t, broker.WithStorage(newTestLogStorage(t, cfg)))
+	indexer := newTestPubSub(t, b)
+	indexer.subscribeGroup("orders", "indexer")
+	auditor := newTestPubSub(t, b)
+	auditor.subscribeGroup("orders", "auditor")
+
+	b.Publish(broker.NewMessage("1", "orders", []byte("1")))
+	b.Ack(indexer.ch, indexer.readMessage().ID)
+	auditor.readMessage()
+	b.Publish(broker.NewMessage("2", "orders", []byte("2")))
+	indexer.readMessage()
+	auditor.readMessage()
+	if err := b.Stop(); err != nil {
+		t.Fatalf("unexpected stop error: %v", err)
+	}
+
+	b = newTestBroker(t, broker.WithStorage(newTestLogStorage(t, cfg)))
+	defer b.Stop()
+
+	// every group gets back only copies it has not acked, whichever
+	// resubscribes first
+	auditor = newTestPubSub(t, b)
+	auditor.subscribeGroup("orders", "auditor")
+	for _, want := range []string{"1", "2"} {
+		got := auditor.readMessage()
+		if got.ID != want {
+			t.Errorf("got wrong recovered auditor message: expected %s got %s", want, got.ID)
+		}
+		b.Ack(auditor.ch, got.ID)
+	}
+
+	indexer = newTestPubSub(t, b)
+	indexer.subscribeGroup("orders", "indexer")
+	if got := indexer.readMessage(); got.ID != "2" {
+		t.Errorf("expected indexer to get back only message 2, got %s", got.ID)
+	}
+	select {
+	case msg := <-indexer.ch:
+		t.Errorf("got message already acked by indexer: %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
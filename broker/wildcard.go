@@ -0,0 +1,126 @@
+package broker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vlaner/postal/schema"
+)
+
+// Topic names are dot-separated tokens. Subscriptions and schemas may use
+// wildcards: "*" matches exactly one token and ">", allowed only as the last
+// token, matches one or more tokens. Tokens starting with "$", such as
+// dead-letter topics, and inboxes are matched only literally.
+const (
+	wildcardOne  = "*"
+	wildcardTail = ">"
+)
+
+func IsWildcard(topic string) bool {
+	for _, token := range strings.Split(topic, ".") {
+		if token == wildcardOne || token == wildcardTail {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateTopic checks topic name or subscription pattern.
+func ValidateTopic(topic string) error {
+	tokens := strings.Split(topic, ".")
+	for i, token := range tokens {
+		if token == "" {
+			return fmt.Errorf("broker: %w: empty token in %q", ErrInvalidTopic, topic)
+		}
+
+		if token == wildcardTail && i != len(tokens)-1 {
+			return fmt.Errorf("broker: %w: %q must be the last token in %q", ErrInvalidTopic, wildcardTail, topic)
+		}
+	}
+
+	return nil
+}
+
+// matchTopic reports whether topic matches subscription pattern.
+func matchTopic(pattern, topic string) bool {
+	if pattern == topic {
+		return true
+	}
+
+	if IsInbox(topic) {
+		return false
+	}
+
+	patternTokens := strings.Split(pattern, ".")
+	topicTokens := strings.Split(topic, ".")
+	for i, token := range patternTokens {
+		if i >= len(topicTokens) {
+			return false
+		}
+
+		switch {
+		case token == wildcardTail:
+			for _, rest := range topicTokens[i:] {
+				if strings.HasPrefix(rest, "$") {
+					return false
+				}
+			}
+			return true
+		case token == wildcardOne:
+			if strings.HasPrefix(topicTokens[i], "$") {
+				return false
+			}
+		case token != topicTokens[i]:
+			return false
+		}
+	}
+
+	return len(patternTokens) == len(topicTokens)
+}
+
+// literalTokens counts tokens which are not wildcards, patterns with more of
+// them are more specific.
+func literalTokens(pattern string) int {
+	n := 0
+	for _, token := range strings.Split(pattern, ".") {
+		if token != wildcardOne && token != wildcardTail {
+			n++
+		}
+	}
+
+	return n
+}
+
+// schemaFor returns schema of the topic, or the one set on the most specific
+// pattern matching it. Schema of a pattern is the one set on it exactly.
+func (b *Broker) schemaFor(name string) *schema.NodeSchema {
+	if IsWildcard(name) {
+		return b.schemaPatterns[name]
+	}
+
+	if topic, ok := b.topics.Get(name); ok && topic.schema != nil {
+		return topic.schema
+	}
+
+	var (
+		found *schema.NodeSchema
+		best  = -1
+	)
+	for pattern, s := range b.schemaPatterns {
+		if n := literalTokens(pattern); matchTopic(pattern, name) && n > best {
+			found, best = s, n
+		}
+	}
+
+	return found
+}
+
+// attachPatterns subscribes consumers of matching patterns to a new topic.
+func (b *Broker) attachPatterns(topic *Topic) {
+	for _, sub := range b.patterns {
+		if matchTopic(sub.Topic, topic.name) {
+			b.attach(topic, sub)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -14,16 +16,54 @@ import (
 )
 
 func main() {
-	if err := run(); err != nil {
+	var err error
+	if len(os.Args) > 1 && os.Args[1] == "redrive" {
+		err = runRedrive(os.Args[2:])
+	} else {
+		err = run(os.Args[1:])
+	}
+
+	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func run() error {
-	broker := broker.NewBroker()
-	go broker.Run()
+func run(args []string) error {
+	flags := flag.NewFlagSet("postal", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "address to listen on")
+	dataDir := flags.String("data-dir", "", "directory for the message log, messages are kept in memory only when empty")
+	fsync := flags.String("fsync", "always", "message log fsync policy: always, interval or never")
+	fsyncInterval := flags.Duration("fsync-interval", time.Second, "how often to fsync the message log with interval policy")
+	segmentSize := flags.Int64("segment-size", 64<<20, "maximum size of a message log segment in bytes")
+	flags.Parse(args)
+
+	var opts []broker.Option
+	if *dataDir != "" {
+		policy, err := broker.ParseFsyncPolicy(*fsync)
+		if err != nil {
+			return err
+		}
+
+		storage, err := broker.NewLogStorage(broker.LogConfig{
+			Dir:           *dataDir,
+			SegmentSize:   *segmentSize,
+			Fsync:         policy,
+			FsyncInterval: *fsyncInterval,
+		})
+		if err != nil {
+			return fmt.Errorf("open message log: %w", err)
+		}
+
+		opts = append(opts, broker.WithStorage(storage))
+	}
+
+	b, err := broker.NewBroker(opts...)
+	if err != nil {
+		return fmt.Errorf("new broker: %w", err)
+	}
+	go b.Run()
 
-	srv, err := server.NewServer(":8080", broker)
+	srv, err := server.NewServer(*addr, b)
 	if err != nil {
 		return fmt.Errorf("new server: %w", err)
 	}
@@ -41,5 +81,5 @@ func run() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	return srv.Stop(ctx)
+	return errors.Join(srv.Stop(ctx), b.Stop())
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vlaner/postal/server"
+)
+
+func runRedrive(args []string) error {
+	flags := flag.NewFlagSet("redrive", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: postal redrive [flags] <dead-letter topic>")
+		flags.PrintDefaults()
+	}
+	addr := flags.String("addr", "127.0.0.1:8080", "address of postal server")
+	ids := flags.String("ids", "", "comma separated IDs of messages to move, all messages when empty")
+	olderThan := flags.Duration("older", 0, "move only messages sent at least this long ago")
+	newerThan := flags.Duration("newer", 0, "move only messages sent at most this long ago")
+	dryRun := flags.Bool("dry-run", false, "only list messages which would be moved")
+	timeout := flags.Duration("timeout", 10*time.Second, "how long to wait for server reply")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("redrive: dead-letter topic is required")
+	}
+
+	cmd := []string{string(server.REDRIVE), flags.Arg(0)}
+	if *ids != "" {
+		cmd = append(cmd, "ids="+*ids)
+	}
+	if *olderThan > 0 {
+		cmd = append(cmd, "older="+olderThan.String())
+	}
+	if *newerThan > 0 {
+		cmd = append(cmd, "newer="+newerThan.String())
+	}
+	if *dryRun {
+		cmd = append(cmd, "dryrun=true")
+	}
+
+	conn, err := net.DialTimeout("tcp", *addr, *timeout)
+	if err != nil {
+		return fmt.Errorf("redrive: connect: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(*timeout)); err != nil {
+		return fmt.Errorf("redrive: set deadline: %w", err)
+	}
+
+	if _, err := fmt.Fprintf(conn, "%s\r\n", strings.Join(cmd, " ")); err != nil {
+		return fmt.Errorf("redrive: send command: %w", err)
+	}
+
+	r := server.NewProtoReader(conn)
+	for {
+		proto, err := r.Parse()
+		if err != nil {
+			return fmt.Errorf("redrive: read reply: %w", err)
+		}
+
+		switch proto.Command {
+		case string(server.ERR):
+			return fmt.Errorf("redrive: %s: %s", proto.Code, proto.Data)
+		case string(server.OK):
+		default:
+			continue
+		}
+
+		var report server.RedriveReport
+		if err := json.Unmarshal(proto.Data, &report); err != nil {
+			return fmt.Errorf("redrive: decode reply: %w", err)
+		}
+
+		printRedriveReport(report)
+		return nil
+	}
+}
+
+func printRedriveReport(report server.RedriveReport) {
+	action := "moved"
+	if report.DryRun {
+		action = "would move"
+	}
+	fmt.Printf("%s %d messages\n", action, len(report.Messages))
+
+	if len(report.Messages) == 0 {
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTOPIC\tSENT AT\tATTEMPTS\tREASON")
+	for _, msg := range report.Messages {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", msg.ID, msg.Topic, msg.SentAt.Format(time.RFC3339), msg.Attempts, msg.Reason)
+	}
+	w.Flush()
+}
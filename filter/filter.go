@@ -0,0 +1,305 @@
+// Package filter implements expressions subscribers use to select messages
+// by fields of their JSON payload, e.g. `amount > 100 and region in ('eu', 'us')`.
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/vlaner/postal/schema"
+)
+
+var ErrInvalidFilter = errors.New("invalid filter")
+
+type Filter struct {
+	src  string
+	expr node
+}
+
+// Parse compiles filter expression.
+func Parse(src string) (*Filter, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.current(); t.typ != tokenEOF {
+		return nil, p.errorf("unexpected %s", t)
+	}
+
+	return &Filter{src: src, expr: expr}, nil
+}
+
+func (f *Filter) String() string {
+	return f.src
+}
+
+// Match reports whether decoded JSON payload satisfies the filter. A
+// comparison with a missing field or a value of another type is false.
+func (f *Filter) Match(data map[string]any) bool {
+	return f.expr.match(data)
+}
+
+// Check type-checks the filter against schema of the topic: every field must
+// exist and be compared with values of its type.
+func (f *Filter) Check(s schema.NodeSchema) error {
+	return f.expr.check(s)
+}
+
+type valueKind int
+
+const (
+	kindNumber valueKind = iota
+	kindString
+	kindBool
+)
+
+func (k valueKind) String() string {
+	switch k {
+	case kindNumber:
+		return "number"
+	case kindString:
+		return "string"
+	}
+
+	return "bool"
+}
+
+type value struct {
+	kind valueKind
+	num  float64
+	str  string
+	b    bool
+}
+
+// fromJSON converts decoded JSON value, ok is false for values filters can
+// not compare.
+func fromJSON(v any) (value, bool) {
+	switch v := v.(type) {
+	case float64:
+		return value{kind: kindNumber, num: v}, true
+	case string:
+		return value{kind: kindString, str: v}, true
+	case bool:
+		return value{kind: kindBool, b: v}, true
+	}
+
+	return value{}, false
+}
+
+// compare returns -1, 0 or 1, ok is false for values of different kinds.
+func compare(a, b value) (int, bool) {
+	if a.kind != b.kind {
+		return 0, false
+	}
+
+	switch a.kind {
+	case kindNumber:
+		switch {
+		case a.num < b.num:
+			return -1, true
+		case a.num > b.num:
+			return 1, true
+		}
+		return 0, true
+	case kindString:
+		return strings.Compare(a.str, b.str), true
+	}
+
+	if a.b == b.b {
+		return 0, true
+	}
+
+	return 1, true
+}
+
+// lookup finds field at dot separated path, preferring exact key match over
+// case-insensitive one like schema validation does.
+func lookup(data map[string]any, path string) (value, bool) {
+	name, rest, nested := strings.Cut(path, ".")
+
+	raw, ok := data[name]
+	if !ok {
+		for key, v := range data {
+			if strings.EqualFold(key, name) {
+				raw, ok = v, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return value{}, false
+	}
+
+	if nested {
+		child, ok := raw.(map[string]any)
+		if !ok {
+			return value{}, false
+		}
+		return lookup(child, rest)
+	}
+
+	return fromJSON(raw)
+}
+
+// fieldKind returns kind of values schema allows for field.
+func fieldKind(s schema.NodeSchema, field string) (valueKind, error) {
+	node, ok := s.Lookup(field)
+	if !ok {
+		return 0, fmt.Errorf("filter: %w: unknown field %q", ErrInvalidFilter, field)
+	}
+
+	switch node.String() {
+	case "int":
+		return kindNumber, nil
+	case "str":
+		return kindString, nil
+	}
+
+	return 0, fmt.Errorf("filter: %w: field %q is an object and can not be compared", ErrInvalidFilter, field)
+}
+
+func checkValue(s schema.NodeSchema, field string, val value) error {
+	kind, err := fieldKind(s, field)
+	if err != nil {
+		return err
+	}
+
+	if val.kind != kind {
+		return fmt.Errorf("filter: %w: field %q is %s but compared with %s", ErrInvalidFilter, field, kind, val.kind)
+	}
+
+	return nil
+}
+
+type node interface {
+	match(data map[string]any) bool
+	check(s schema.NodeSchema) error
+}
+
+type orNode struct{ left, right node }
+
+func (n orNode) match(data map[string]any) bool {
+	return n.left.match(data) || n.right.match(data)
+}
+
+func (n orNode) check(s schema.NodeSchema) error {
+	return errors.Join(n.left.check(s), n.right.check(s))
+}
+
+type andNode struct{ left, right node }
+
+func (n andNode) match(data map[string]any) bool {
+	return n.left.match(data) && n.right.match(data)
+}
+
+func (n andNode) check(s schema.NodeSchema) error {
+	return errors.Join(n.left.check(s), n.right.check(s))
+}
+
+type notNode struct{ x node }
+
+func (n notNode) match(data map[string]any) bool {
+	return !n.x.match(data)
+}
+
+func (n notNode) check(s schema.NodeSchema) error {
+	return n.x.check(s)
+}
+
+type compareNode struct {
+	field string
+	op    string
+	value value
+}
+
+func (n compareNode) match(data map[string]any) bool {
+	val, ok := lookup(data, n.field)
+	if !ok {
+		return false
+	}
+
+	c, ok := compare(val, n.value)
+	if !ok {
+		return false
+	}
+
+	switch n.op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	}
+
+	// bools have no order
+	if val.kind == kindBool {
+		return false
+	}
+
+	switch n.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+
+	return false
+}
+
+func (n compareNode) check(s schema.NodeSchema) error {
+	return checkValue(s, n.field, n.value)
+}
+
+type inNode struct {
+	field  string
+	values []value
+}
+
+func (n inNode) match(data map[string]any) bool {
+	val, ok := lookup(data, n.field)
+	if !ok {
+		return false
+	}
+
+	for _, v := range n.values {
+		if c, ok := compare(val, v); ok && c == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (n inNode) check(s schema.NodeSchema) error {
+	var errs []error
+	for _, v := range n.values {
+		errs = append(errs, checkValue(s, n.field, v))
+	}
+
+	return errors.Join(errs...)
+}
+
+type prefixNode struct {
+	field  string
+	prefix string
+}
+
+func (n prefixNode) match(data map[string]any) bool {
+	val, ok := lookup(data, n.field)
+	return ok && val.kind == kindString && strings.HasPrefix(val.str, n.prefix)
+}
+
+func (n prefixNode) check(s schema.NodeSchema) error {
+	return checkValue(s, n.field, value{kind: kindString, str: n.prefix})
+}
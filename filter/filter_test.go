@@ -0,0 +1,107 @@
+package filter
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/vlaner/postal/schema"
+)
+
+func TestMatch(t *testing.T) {
+	var data map[string]any
+	payload := `{"amount": 150, "region": "eu-west", "paid": true, "customer": {"tier": "gold"}}`
+	if err := json.Unmarshal([]byte(payload), &data); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		expr string
+		want bool
+	}{
+		{expr: "amount > 100", want: true},
+		{expr: "amount <= 100", want: false},
+		{expr: "amount = 150 and paid = true", want: true},
+		{expr: "amount < 100 or region = 'eu-west'", want: true},
+		{expr: "not (amount < 100 or paid = false)", want: true},
+		{expr: "region in ('us', \"eu-west\")", want: true},
+		{expr: "region prefix 'us'", want: false},
+		{expr: "customer.tier = 'gold'", want: true},
+		{expr: "Amount >= 150", want: true},
+		{expr: "missing = 1", want: false},
+		{expr: "missing != 1", want: false},
+		{expr: "amount = 'big'", want: false},
+		{expr: "amount > -1 AND region PREFIX 'eu'", want: true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.expr, func(t *testing.T) {
+			f, err := Parse(tC.expr)
+			if err != nil {
+				t.Fatalf("unexpected parse error: %v", err)
+			}
+
+			if got := f.Match(data); got != tC.want {
+				t.Errorf("got wrong match: expected %v got %v", tC.want, got)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"amount >",
+		"amount > 1 and",
+		"(amount > 1",
+		"amount ! 1",
+		"region = 'eu",
+		"region in ('eu' 'us')",
+		"region prefix 1",
+		"and = 1",
+		"amount > 1 region = 'eu'",
+	} {
+		if _, err := Parse(expr); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("expected invalid filter error for %q, got %v", expr, err)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	p, err := schema.NewParserString(`[ amount > int region > str customer > [ tier > str ] ]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{expr: "amount > 1 and region in ('eu', 'us')"},
+		{expr: "customer.tier prefix 'g'"},
+		{expr: "amount = 'big'", wantErr: true},
+		{expr: "region prefix 'eu' or amount in (1, 'two')", wantErr: true},
+		{expr: "unknown = 1", wantErr: true},
+		{expr: "customer = 'x'", wantErr: true},
+		{expr: "amount prefix '1'", wantErr: true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.expr, func(t *testing.T) {
+			f, err := Parse(tC.expr)
+			if err != nil {
+				t.Fatalf("unexpected parse error: %v", err)
+			}
+
+			err = f.Check(s)
+			if tC.wantErr != (err != nil) {
+				t.Errorf("got wrong check result: expected error %v got %v", tC.wantErr, err)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidFilter) {
+				t.Errorf("expected invalid filter error, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOp
+	tokenLParen
+	tokenRParen
+	tokenComma
+)
+
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+func (t token) String() string {
+	if t.typ == tokenEOF {
+		return "end of expression"
+	}
+
+	return fmt.Sprintf("%q at %d", t.val, t.pos)
+}
+
+// isKeyword reports whether identifier token is the given keyword, keywords
+// are case-insensitive.
+func (t token) isKeyword(keyword string) bool {
+	return t.typ == tokenIdent && strings.EqualFold(t.val, keyword)
+}
+
+func tokenize(input string) ([]token, error) {
+	var tokens []token
+	runes := []rune(input)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{typ: tokenLParen, val: "(", pos: i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{typ: tokenRParen, val: ")", pos: i})
+			i++
+		case r == ',':
+			tokens = append(tokens, token{typ: tokenComma, val: ",", pos: i})
+			i++
+		case r == '=' || r == '!' || r == '<' || r == '>':
+			op := string(r)
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				op += "="
+			}
+			if op == "!" {
+				return nil, fmt.Errorf("filter: %w: unexpected %q at %d", ErrInvalidFilter, op, i)
+			}
+			tokens = append(tokens, token{typ: tokenOp, val: op, pos: i})
+			i += len(op)
+		case r == '\'' || r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("filter: %w: unterminated string at %d", ErrInvalidFilter, i)
+			}
+			tokens = append(tokens, token{typ: tokenString, val: string(runes[i+1 : end]), pos: i})
+			i = end + 1
+		case r == '-' || unicode.IsDigit(r):
+			end := i + 1
+			for end < len(runes) && (unicode.IsDigit(runes[end]) || runes[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, token{typ: tokenNumber, val: string(runes[i:end]), pos: i})
+			i = end
+		case unicode.IsLetter(r) || r == '_':
+			end := i + 1
+			for end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end]) || runes[end] == '_' || runes[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, token{typ: tokenIdent, val: string(runes[i:end]), pos: i})
+			i = end
+		default:
+			return nil, fmt.Errorf("filter: %w: unexpected %q at %d", ErrInvalidFilter, r, i)
+		}
+	}
+
+	return append(tokens, token{typ: tokenEOF, pos: len(runes)}), nil
+}
@@ -0,0 +1,173 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Grammar, keywords are case-insensitive:
+//
+//	expr       = and { "or" and }
+//	and        = unary { "and" unary }
+//	unary      = "not" unary | "(" expr ")" | comparison
+//	comparison = field op value | field "in" "(" value { "," value } ")" | field "prefix" string
+//	op         = "=" | "!=" | "<" | "<=" | ">" | ">="
+//	value      = number | string | "true" | "false"
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) current() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokenEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("filter: %w: %s", ErrInvalidFilter, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.current().isKeyword("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.current().isKeyword("and") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	switch t := p.current(); {
+	case t.isKeyword("not"):
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{x: x}, nil
+	case t.typ == tokenLParen:
+		p.next()
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.typ != tokenRParen {
+			return nil, p.errorf("expected ')' but got %s", t)
+		}
+		return x, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	field := p.next()
+	if field.typ != tokenIdent || isReserved(field) {
+		return nil, p.errorf("expected field name but got %s", field)
+	}
+
+	switch op := p.next(); {
+	case op.typ == tokenOp:
+		val, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return compareNode{field: field.val, op: op.val, value: val}, nil
+
+	case op.isKeyword("in"):
+		if t := p.next(); t.typ != tokenLParen {
+			return nil, p.errorf("expected '(' after in but got %s", t)
+		}
+
+		var values []value
+		for {
+			val, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, val)
+
+			t := p.next()
+			if t.typ == tokenRParen {
+				break
+			}
+			if t.typ != tokenComma {
+				return nil, p.errorf("expected ',' or ')' but got %s", t)
+			}
+		}
+		return inNode{field: field.val, values: values}, nil
+
+	case op.isKeyword("prefix"):
+		t := p.next()
+		if t.typ != tokenString {
+			return nil, p.errorf("expected string after prefix but got %s", t)
+		}
+		return prefixNode{field: field.val, prefix: t.val}, nil
+
+	default:
+		return nil, p.errorf("expected operator after %q but got %s", field.val, op)
+	}
+}
+
+func (p *parser) parseValue() (value, error) {
+	t := p.next()
+	switch {
+	case t.typ == tokenString:
+		return value{kind: kindString, str: t.val}, nil
+	case t.typ == tokenNumber:
+		num, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return value{}, p.errorf("wrong number %s", t)
+		}
+		return value{kind: kindNumber, num: num}, nil
+	case t.isKeyword("true"), t.isKeyword("false"):
+		return value{kind: kindBool, b: t.isKeyword("true")}, nil
+	}
+
+	return value{}, p.errorf("expected value but got %s", t)
+}
+
+func isReserved(t token) bool {
+	for _, keyword := range []string{"and", "or", "not", "in", "prefix", "true", "false"} {
+		if t.isKeyword(keyword) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,6 +1,9 @@
 package schema
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type NodeType string
 
@@ -64,3 +67,27 @@ func (n NodeSchema) Type() NodeType {
 func (n NodeSchema) String() string {
 	return "body"
 }
+
+// Lookup returns node describing field at dot separated path. Names match
+// case-insensitively, same as in validation.
+func (n NodeSchema) Lookup(path string) (Node, bool) {
+	name, rest, nested := strings.Cut(path, ".")
+	for _, assign := range n.body {
+		if !strings.EqualFold(assign.ident.String(), name) {
+			continue
+		}
+
+		if !nested {
+			return assign.val, true
+		}
+
+		child, ok := assign.val.(NodeSchema)
+		if !ok {
+			return nil, false
+		}
+
+		return child.Lookup(rest)
+	}
+
+	return nil, false
+}
@@ -62,6 +62,11 @@ func (p *Parser) Parse() (NodeSchema, error) {
 }
 
 func (p *Parser) readToken() {
+	if len(p.tokens) == 0 {
+		p.current = Token{typ: TOKEN_EOF}
+		return
+	}
+
 	p.current = p.tokens[0]
 	p.tokens = p.tokens[1:]
 }
@@ -89,9 +94,13 @@ func (p *Parser) parseAssignment() (NodeAssign, error) {
 	case TOKEN_LBRACKET:
 		nested, err := p.Parse()
 		if err != nil {
-			return NodeAssign{}, nil
+			return NodeAssign{}, err
 		}
 		n.val = nested
+		p.readToken() // consume ]
+
+	default:
+		return NodeAssign{}, fmt.Errorf("%s is not type or nested schema", p.current.typ)
 	}
 
 	return n, nil
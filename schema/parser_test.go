@@ -1,6 +1,8 @@
 package schema
 
 import (
+	"encoding/json"
+	"errors"
 	"testing"
 )
 
@@ -103,3 +105,83 @@ func TestNestedIncorrectSchema(t *testing.T) {
 		t.Error("unexpected nil error")
 	}
 }
+
+func TestValidateMap(t *testing.T) {
+	p, err := NewParserString(`
+[
+    x > [
+		y > int
+	]
+	z > str
+]
+	`)
+	if err != nil {
+		t.Fatal("unexpected new parser from string", err)
+	}
+
+	schema, err := p.Parse()
+	if err != nil {
+		t.Fatal("unexpected parse schema", err)
+	}
+
+	testCases := []struct {
+		desc    string
+		payload string
+		field   string
+	}{
+		{
+			desc:    "valid payload",
+			payload: `{"x": {"y": 1}, "z": "z"}`,
+		},
+		{
+			desc:    "field after nested schema",
+			payload: `{"x": {"y": 1}}`,
+			field:   "z",
+		},
+		{
+			desc:    "fractional int",
+			payload: `{"x": {"y": 1.5}, "z": "z"}`,
+			field:   "x.y",
+		},
+		{
+			desc:    "not an object",
+			payload: `{"x": "y", "z": "z"}`,
+			field:   "x",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var data map[string]any
+			if err := json.Unmarshal([]byte(tC.payload), &data); err != nil {
+				t.Fatal(err)
+			}
+
+			err := ValidateMap(schema, data)
+			if tC.field == "" {
+				if err != nil {
+					t.Errorf("unexpected validate error %v", err)
+				}
+				return
+			}
+
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("expected validation error, got %v", err)
+			}
+			if verr.Field != tC.field {
+				t.Errorf("got wrong field: expected %q got %q", tC.field, verr.Field)
+			}
+		})
+	}
+}
+
+func TestWrongNestedSchema(t *testing.T) {
+	p, err := NewParserString(`[ x > [ y > ] ]`)
+	if err != nil {
+		t.Fatal("unexpected new parser from string", err)
+	}
+
+	if _, err := p.Parse(); err == nil {
+		t.Error("unexpected nil error")
+	}
+}
@@ -1,7 +1,10 @@
 package schema
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"reflect"
 	"strings"
 )
@@ -88,6 +91,23 @@ func validateNode(node Node, val reflect.Value) error {
 	return nil
 }
 
+// ValidationError describes why a payload does not match a schema.
+type ValidationError struct {
+	// Field is dot separated path to the offending field.
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Field == "" {
+		return e.Reason
+	}
+
+	return fmt.Sprintf("field %q: %s", e.Field, e.Reason)
+}
+
+// ValidateMap checks decoded JSON object against schema. Returned error is
+// *ValidationError.
 func ValidateMap(schema NodeSchema, data map[string]any) error {
 	for _, assign := range schema.body {
 		key := assign.ident.String()
@@ -101,12 +121,17 @@ func ValidateMap(schema NodeSchema, data map[string]any) error {
 		}
 
 		if foundKey == "" {
-			return fmt.Errorf("missing field %q in payload", key)
+			return &ValidationError{Field: key, Reason: "missing field"}
 		}
 
 		value := data[foundKey]
 		if err := validateNodeMap(assign.val, value); err != nil {
-			return fmt.Errorf("validate field %q: %w", key, err)
+			var verr *ValidationError
+			if errors.As(err, &verr) {
+				return &ValidationError{Field: key + "." + verr.Field, Reason: verr.Reason}
+			}
+
+			return &ValidationError{Field: key, Reason: err.Error()}
 		}
 	}
 	return nil
@@ -117,13 +142,12 @@ func validateNodeMap(node Node, value interface{}) error {
 	case NodeLiteral:
 		switch n.name {
 		case "int":
-			_, ok := value.(int)
-			if !ok {
-				return fmt.Errorf("expected number, got %T", value)
+			if !isInteger(value) {
+				return fmt.Errorf("expected int, got %s", jsonType(value))
 			}
 		case "str":
 			if _, ok := value.(string); !ok {
-				return fmt.Errorf("expected string, got %T", value)
+				return fmt.Errorf("expected str, got %s", jsonType(value))
 			}
 		default:
 			return fmt.Errorf("unsupported literal type: %s", n.name)
@@ -131,7 +155,7 @@ func validateNodeMap(node Node, value interface{}) error {
 	case NodeSchema:
 		m, ok := value.(map[string]interface{})
 		if !ok {
-			return fmt.Errorf("expected object for nested schema, got %T", value)
+			return fmt.Errorf("expected object, got %s", jsonType(value))
 		}
 		return ValidateMap(n, m)
 	default:
@@ -139,3 +163,37 @@ func validateNodeMap(node Node, value interface{}) error {
 	}
 	return nil
 }
+
+// isInteger reports whether value decoded from JSON is a whole number.
+func isInteger(value any) bool {
+	switch v := value.(type) {
+	case int, int64:
+		return true
+	case float64:
+		return v == math.Trunc(v) && !math.IsInf(v, 0)
+	case json.Number:
+		_, err := v.Int64()
+		return err == nil
+	}
+
+	return false
+}
+
+func jsonType(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case float64, int, int64, json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+
+	return fmt.Sprintf("%T", value)
+}
@@ -7,46 +7,268 @@ import (
 	"fmt"
 	"io"
 	"net/textproto"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vlaner/postal/broker"
+	"github.com/vlaner/postal/filter"
 )
 
 func WrongTokensNumber(expected, got int) error {
-	return fmt.Errorf("proto: wrong tokens count: expected %d but got %d", expected, got)
+	return fmt.Errorf("proto: wrong tokens count: expected %d but got %d: %w", expected, got, ErrInvalidProto)
 }
 
 func WrongCommand(cmd string) error {
-	return fmt.Errorf("proto: wrong command: expected one of %q, %q, %q  or %q but got %q", PUBLISH, SUBSCRIBE, MESSAGE, UNSUBSCRIBE, cmd)
+	return fmt.Errorf("proto: wrong command: expected one of %s but got %q: %w", bytes.Join(commands, []byte(", ")), cmd, ErrUnknownCommand)
 }
 
-var ErrInvalidProto = errors.New("invalid proto data")
+var (
+	ErrInvalidProto   = errors.New("invalid proto data")
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrInvalidSchema  = errors.New("invalid schema")
+	ErrTimeout        = errors.New("timeout")
+)
+
+// Error codes sent in -ERR replies. Codes are stable, messages may change.
+const (
+	CodeProto          = "PROTO"
+	CodeUnknownCommand = "UNKNOWN_COMMAND"
+	CodeInvalidSchema  = "INVALID_SCHEMA"
+	CodeInvalidPayload = "INVALID_PAYLOAD"
+	CodeInvalidOption  = "INVALID_OPTION"
+	CodeInvalidTopic   = "INVALID_TOPIC"
+	CodeInvalidFilter  = "INVALID_FILTER"
+	CodeNotFound       = "NOT_FOUND"
+	CodeTimeout        = "TIMEOUT"
+	CodeInternal       = "INTERNAL"
+)
+
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrInvalidProto):
+		return CodeProto
+	case errors.Is(err, ErrUnknownCommand):
+		return CodeUnknownCommand
+	case errors.Is(err, ErrInvalidSchema):
+		return CodeInvalidSchema
+	case errors.Is(err, broker.ErrInvalidPayload):
+		return CodeInvalidPayload
+	case errors.Is(err, broker.ErrInvalidOption):
+		return CodeInvalidOption
+	case errors.Is(err, broker.ErrInvalidTopic):
+		return CodeInvalidTopic
+	case errors.Is(err, filter.ErrInvalidFilter):
+		return CodeInvalidFilter
+	case errors.Is(err, broker.ErrTopicNotFound):
+		return CodeNotFound
+	case errors.Is(err, ErrTimeout):
+		return CodeTimeout
+	}
+
+	return CodeInternal
+}
 
 var (
 	PUBLISH     = []byte("PUB")
 	SUBSCRIBE   = []byte("SUB")
 	UNSUBSCRIBE = []byte("UNSUB")
 	MESSAGE     = []byte("MSG")
+	HPUBLISH    = []byte("HPUB")
+	HMESSAGE    = []byte("HMSG")
 	ACK         = []byte("ACK")
+	NACK        = []byte("NACK")
 	SCHEMA      = []byte("SCHEMA")
+	CONFIG      = []byte("CONFIG")
+	REDRIVE     = []byte("REDRIVE")
+	REQUEST     = []byte("REQ")
+	FETCH       = []byte("FETCH")
+	CREDIT      = []byte("CREDIT")
+	WHERE       = []byte("WHERE")
+	OK          = []byte("+OK")
+	ERR         = []byte("-ERR")
 )
 
+// commands are sent by clients, other frames are server replies.
+var commands = [][]byte{PUBLISH, HPUBLISH, SUBSCRIBE, UNSUBSCRIBE, ACK, NACK, SCHEMA, CONFIG, REDRIVE, REQUEST, FETCH, CREDIT}
+
 type Proto struct {
 	MessageID  string
 	Command    string
 	Topic      string
+	Group      string
 	PayloadLen int
 	Data       []byte
 	Schema     string
+	Options    map[string]string
+	Delay      time.Duration
+	Reason     string
+	// Code is error code of -ERR reply, its message is in Data.
+	Code string
+	// Seq is client sequence number of PUB echoed in its reply so pipelined
+	// publishes can be matched with their confirms.
+	Seq string
+	// Headers are sent with HPUB and HMSG frames.
+	Headers map[string]string
+	// Filter is expression of SUB ... WHERE.
+	Filter string
+	// Max is how many messages FETCH asks for, its wait is in Delay, or
+	// how many CREDIT grants.
+	Max int
+	// MessageIDs are all IDs of ACK, MessageID is the first of them.
+	MessageIDs []string
+	// DeliverySeq of MSG and HMSG is what cumulative ACK refers to.
+	DeliverySeq uint64
+}
+
+// OKProto is a success reply with optional single line data.
+func OKProto(data string) Proto {
+	return Proto{Command: string(OK), Data: []byte(data)}
+}
+
+// ErrorProto is an error reply with code matching err.
+func ErrorProto(err error) Proto {
+	return Proto{Command: string(ERR), Code: errorCode(err), Data: []byte(err.Error())}
+}
+
+// parseOptions reads trailing key=value tokens of a command.
+func parseOptions(tokens [][]byte) (map[string]string, error) {
+	opts := make(map[string]string, len(tokens))
+	for _, token := range tokens {
+		key, val, ok := bytes.Cut(token, []byte("="))
+		if !ok || len(key) == 0 {
+			return nil, fmt.Errorf("proto: wrong option %q: expected key=value: %w", token, ErrInvalidProto)
+		}
+
+		opts[string(key)] = string(val)
+	}
+
+	return opts, nil
 }
 
 func (p Proto) Marshal() []byte {
 	switch p.Command {
 	case string(MESSAGE):
-		return []byte(fmt.Sprintf("%s %s %s %d\r\n%s\r\n", p.Command, p.Topic, p.MessageID, len(p.Data), p.Data))
+		return []byte(fmt.Sprintf("%s %s %s %d%s\r\n%s\r\n", p.Command, p.Topic, p.MessageID, len(p.Data), p.deliverySeq(), p.Data))
+	case string(HMESSAGE):
+		headers := marshalHeaders(p.Headers)
+		return []byte(fmt.Sprintf("%s %s %s %d %d%s\r\n%s%s\r\n", p.Command, p.Topic, p.MessageID, len(headers), len(headers)+len(p.Data), p.deliverySeq(), headers, p.Data))
+	case string(OK):
+		head := p.replyHead()
+		if len(p.Data) == 0 {
+			return []byte(fmt.Sprintf("%s\r\n", head))
+		}
+		return []byte(fmt.Sprintf("%s %s\r\n", head, singleLine(p.Data)))
+	case string(ERR):
+		return []byte(fmt.Sprintf("%s %s %s\r\n", p.replyHead(), p.Code, singleLine(p.Data)))
 	}
 
 	return nil
 }
 
+// marshalHeaders encodes headers as "Key: Value" lines followed by an empty
+// line, keys are sorted.
+func marshalHeaders(headers map[string]string) []byte {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "%s: %s\r\n", singleLine([]byte(key)), singleLine([]byte(headers[key])))
+	}
+	buf.WriteString("\r\n")
+
+	return buf.Bytes()
+}
+
+func parseHeaders(block []byte) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, line := range bytes.Split(block, []byte("\r\n")) {
+		if len(line) == 0 {
+			continue
+		}
+
+		key, val, ok := bytes.Cut(line, []byte(":"))
+		key = bytes.TrimSpace(key)
+		if !ok || len(key) == 0 {
+			return nil, fmt.Errorf("proto: wrong header %q: expected key: value: %w", line, ErrInvalidProto)
+		}
+
+		headers[string(key)] = string(bytes.TrimSpace(val))
+	}
+
+	return headers, nil
+}
+
+// deliverySeq is trailing delivery sequence token of a message frame.
+func (p Proto) deliverySeq() string {
+	if p.DeliverySeq == 0 {
+		return ""
+	}
+
+	return " " + strconv.FormatUint(p.DeliverySeq, 10)
+}
+
+// parseDeliverySeq reads optional delivery sequence token of a message frame.
+func parseDeliverySeq(tokens [][]byte) (uint64, error) {
+	if len(tokens) == 0 {
+		return 0, nil
+	}
+
+	seq, err := strconv.ParseUint(string(tokens[0]), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("proto: wrong delivery sequence %q: %w", tokens[0], ErrInvalidProto)
+	}
+
+	return seq, nil
+}
+
+// replyHead is reply command followed by sequence number, if any.
+func (p Proto) replyHead() string {
+	if p.Seq == "" {
+		return p.Command
+	}
+
+	return fmt.Sprintf("%s seq=%s", p.Command, p.Seq)
+}
+
+// cutSeq removes leading seq=<n> token of a reply.
+func cutSeq(tokens [][]byte) (string, [][]byte) {
+	if len(tokens) > 0 && bytes.HasPrefix(tokens[0], []byte("seq=")) {
+		return string(tokens[0][len("seq="):]), tokens[1:]
+	}
+
+	return "", tokens
+}
+
+func singleLine(data []byte) []byte {
+	return bytes.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, data)
+}
+
+// isNumber reports whether token is made of decimal digits only.
+func isNumber(token []byte) bool {
+	if len(token) == 0 {
+		return false
+	}
+
+	for _, c := range token {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
 type ProtoReader struct {
 	reader *textproto.Reader
 }
@@ -57,39 +279,133 @@ func NewProtoReader(r io.Reader) *ProtoReader {
 }
 
 func (p *ProtoReader) Parse() (Proto, error) {
-	line, err := p.reader.ReadLineBytes()
+	line, err := p.readLine()
 	if err != nil {
 		return Proto{}, err
 	}
 
-	line = bytes.TrimSpace(line)
 	tokens := bytes.Split(line, []byte(" "))
 	if len(tokens) < 1 {
 		return Proto{}, WrongTokensNumber(1, 0)
 	}
 
 	switch {
+	case bytes.Equal(tokens[0], OK):
+		seq, rest := cutSeq(tokens[1:])
+		return Proto{
+			Command: string(OK),
+			Seq:     seq,
+			Data:    bytes.Join(rest, []byte(" ")),
+		}, nil
+
+	case bytes.Equal(tokens[0], ERR):
+		seq, rest := cutSeq(tokens[1:])
+		if len(rest) < 1 {
+			return Proto{}, WrongTokensNumber(2, len(tokens))
+		}
+
+		return Proto{
+			Command: string(ERR),
+			Seq:     seq,
+			Code:    string(rest[0]),
+			Data:    bytes.Join(rest[1:], []byte(" ")),
+		}, nil
+
+	case bytes.HasPrefix(line, HPUBLISH):
+		if len(tokens) < 4 {
+			return Proto{}, WrongTokensNumber(4, len(tokens))
+		}
+
+		headers, payload, err := p.readHeadersPayload(tokens[2], tokens[3])
+		if err != nil {
+			return Proto{}, err
+		}
+
+		proto, err := publishProto(tokens[1], payload, tokens[4:])
+		if err != nil {
+			return Proto{}, err
+		}
+		proto.Headers = headers
+
+		return proto, nil
+
 	case bytes.HasPrefix(line, PUBLISH):
 		if len(tokens) < 3 {
 			return Proto{}, WrongTokensNumber(3, len(tokens))
 		}
 
-		payloadLen, err := strconv.Atoi(string(tokens[2]))
+		payload, err := p.readPayload(tokens[2])
+		if err != nil {
+			return Proto{}, err
+		}
+
+		return publishProto(tokens[1], payload, tokens[3:])
+
+	case bytes.HasPrefix(line, REQUEST):
+		if len(tokens) < 3 {
+			return Proto{}, WrongTokensNumber(3, len(tokens))
+		}
+
+		payload, err := p.readPayload(tokens[2])
+		if err != nil {
+			return Proto{}, err
+		}
+
+		proto, err := publishProto(tokens[1], payload, tokens[3:])
+		if err != nil {
+			return Proto{}, err
+		}
+		proto.Command = string(REQUEST)
+
+		return proto, nil
+
+	case bytes.HasPrefix(line, HMESSAGE):
+		if len(tokens) < 5 {
+			return Proto{}, WrongTokensNumber(5, len(tokens))
+		}
+
+		headers, payload, err := p.readHeadersPayload(tokens[3], tokens[4])
 		if err != nil {
 			return Proto{}, err
 		}
 
-		payload := make([]byte, payloadLen)
-		_, err = p.reader.R.Read(payload)
+		seq, err := parseDeliverySeq(tokens[5:])
 		if err != nil {
 			return Proto{}, err
 		}
 
 		return Proto{
-			Command:    string(PUBLISH),
-			Topic:      string(tokens[1]),
-			PayloadLen: payloadLen,
-			Data:       payload,
+			Command:     string(HMESSAGE),
+			Topic:       string(tokens[1]),
+			MessageID:   string(tokens[2]),
+			PayloadLen:  len(payload),
+			Data:        payload,
+			Headers:     headers,
+			DeliverySeq: seq,
+		}, nil
+
+	case bytes.HasPrefix(line, MESSAGE):
+		if len(tokens) < 4 {
+			return Proto{}, WrongTokensNumber(4, len(tokens))
+		}
+
+		payload, err := p.readPayload(tokens[3])
+		if err != nil {
+			return Proto{}, err
+		}
+
+		seq, err := parseDeliverySeq(tokens[4:])
+		if err != nil {
+			return Proto{}, err
+		}
+
+		return Proto{
+			Command:     string(MESSAGE),
+			Topic:       string(tokens[1]),
+			MessageID:   string(tokens[2]),
+			PayloadLen:  len(payload),
+			Data:        payload,
+			DeliverySeq: seq,
 		}, nil
 
 	case bytes.HasPrefix(line, SUBSCRIBE):
@@ -97,10 +413,37 @@ func (p *ProtoReader) Parse() (Proto, error) {
 			return Proto{}, WrongTokensNumber(2, len(tokens))
 		}
 
-		return Proto{
+		proto := Proto{
 			Command: string(SUBSCRIBE),
 			Topic:   string(tokens[1]),
-		}, nil
+		}
+
+		// filter expression takes the rest of the line after WHERE
+		args := tokens[2:]
+		for i, token := range args {
+			if bytes.EqualFold(token, WHERE) {
+				proto.Filter = string(bytes.Join(args[i+1:], []byte(" ")))
+				if proto.Filter == "" {
+					return Proto{}, fmt.Errorf("proto: empty filter after %s: %w", WHERE, ErrInvalidProto)
+				}
+				args = args[:i]
+				break
+			}
+		}
+
+		// options follow the optional group
+		if len(args) > 0 && !bytes.Contains(args[0], []byte("=")) {
+			proto.Group = string(args[0])
+			args = args[1:]
+		}
+
+		opts, err := parseOptions(args)
+		if err != nil {
+			return Proto{}, err
+		}
+		proto.Options = opts
+
+		return proto, nil
 
 	case bytes.HasPrefix(line, UNSUBSCRIBE):
 		if len(tokens) < 2 {
@@ -117,23 +460,125 @@ func (p *ProtoReader) Parse() (Proto, error) {
 			return Proto{}, WrongTokensNumber(2, len(tokens))
 		}
 
-		return Proto{
-			Command:   string(ACK),
+		// IDs are followed by options
+		proto := Proto{Command: string(ACK)}
+		args := tokens[1:]
+		for len(args) > 0 && !bytes.Contains(args[0], []byte("=")) {
+			proto.MessageIDs = append(proto.MessageIDs, string(args[0]))
+			args = args[1:]
+		}
+		if len(proto.MessageIDs) > 0 {
+			proto.MessageID = proto.MessageIDs[0]
+		}
+
+		opts, err := parseOptions(args)
+		if err != nil {
+			return Proto{}, err
+		}
+		proto.Options = opts
+
+		// cumulative ack names topic of the subscription instead of IDs
+		if _, ok := opts["upto"]; ok {
+			if len(proto.MessageIDs) != 1 {
+				return Proto{}, fmt.Errorf("proto: cumulative ack expects single topic: %w", ErrInvalidProto)
+			}
+			proto.Topic = proto.MessageIDs[0]
+			proto.MessageID, proto.MessageIDs = "", nil
+		}
+
+		return proto, nil
+
+	case bytes.HasPrefix(line, NACK):
+		if len(tokens) < 2 {
+			return Proto{}, WrongTokensNumber(2, len(tokens))
+		}
+
+		proto := Proto{
+			Command:   string(NACK),
 			MessageID: string(tokens[1]),
-		}, nil
+		}
 
-	case bytes.HasPrefix(line, SCHEMA):
+		// a number right after the id is the delay, reason takes the rest of
+		// the line; a reason starting with a number goes after "--"
+		rest := tokens[2:]
+		if len(rest) > 0 && isNumber(rest[0]) {
+			delayMs, err := strconv.Atoi(string(rest[0]))
+			if err != nil {
+				return Proto{}, fmt.Errorf("proto: wrong nack delay %q: %w", rest[0], ErrInvalidProto)
+			}
+			proto.Delay = time.Duration(delayMs) * time.Millisecond
+			rest = rest[1:]
+		}
+		if len(rest) > 0 && string(rest[0]) == "--" {
+			rest = rest[1:]
+		}
+		proto.Reason = string(bytes.Join(rest, []byte(" ")))
+
+		return proto, nil
+
+	case bytes.HasPrefix(line, FETCH):
 		if len(tokens) < 3 {
 			return Proto{}, WrongTokensNumber(3, len(tokens))
 		}
 
-		schemaLen, err := strconv.Atoi(string(tokens[2]))
+		size, err := strconv.Atoi(string(tokens[2]))
+		if err != nil || size <= 0 {
+			return Proto{}, fmt.Errorf("proto: wrong fetch size %q: %w", tokens[2], ErrInvalidProto)
+		}
+
+		proto := Proto{
+			Command: string(FETCH),
+			Topic:   string(tokens[1]),
+			Max:     size,
+		}
+
+		// wait is positional, group is an option so a numeric group name is
+		// not taken for the wait
+		rest := tokens[3:]
+		if len(rest) > 0 && !bytes.Contains(rest[0], []byte("=")) {
+			waitMs, err := strconv.Atoi(string(rest[0]))
+			if err != nil || waitMs < 0 {
+				return Proto{}, fmt.Errorf("proto: wrong fetch wait %q: %w", rest[0], ErrInvalidProto)
+			}
+			proto.Delay = time.Duration(waitMs) * time.Millisecond
+			rest = rest[1:]
+		}
+
+		opts, err := parseOptions(rest)
 		if err != nil {
 			return Proto{}, err
 		}
+		for key, val := range opts {
+			if key != "group" {
+				return Proto{}, fmt.Errorf("proto: unknown fetch option %q: %w", key, ErrInvalidProto)
+			}
+			proto.Group = val
+		}
+
+		return proto, nil
+
+	case bytes.HasPrefix(line, CREDIT):
+		if len(tokens) < 3 {
+			return Proto{}, WrongTokensNumber(3, len(tokens))
+		}
 
-		schemaBytes := make([]byte, schemaLen)
-		_, err = p.reader.R.Read(schemaBytes)
+		credit, err := strconv.Atoi(string(tokens[2]))
+		if err != nil || credit <= 0 {
+			return Proto{}, fmt.Errorf("proto: wrong credit %q: %w", tokens[2], ErrInvalidProto)
+		}
+
+		return Proto{
+			Command: string(CREDIT),
+			Topic:   string(tokens[1]),
+			Max:     credit,
+		}, nil
+
+	case bytes.HasPrefix(line, SCHEMA):
+		if len(tokens) < 3 {
+			return Proto{}, WrongTokensNumber(3, len(tokens))
+		}
+
+		schemaBytes, err := p.readPayload(tokens[2])
 		if err != nil {
 			return Proto{}, err
 		}
@@ -143,21 +588,144 @@ func (p *ProtoReader) Parse() (Proto, error) {
 			Topic:   string(tokens[1]),
 			Schema:  string(schemaBytes),
 		}, nil
+
+	case bytes.HasPrefix(line, CONFIG):
+		if len(tokens) < 3 {
+			return Proto{}, WrongTokensNumber(3, len(tokens))
+		}
+
+		opts, err := parseOptions(tokens[2:])
+		if err != nil {
+			return Proto{}, err
+		}
+
+		return Proto{
+			Command: string(CONFIG),
+			Topic:   string(tokens[1]),
+			Options: opts,
+		}, nil
+
+	case bytes.HasPrefix(line, REDRIVE):
+		if len(tokens) < 2 {
+			return Proto{}, WrongTokensNumber(2, len(tokens))
+		}
+
+		opts, err := parseOptions(tokens[2:])
+		if err != nil {
+			return Proto{}, err
+		}
+
+		return Proto{
+			Command: string(REDRIVE),
+			Topic:   string(tokens[1]),
+			Options: opts,
+		}, nil
 	}
 
 	return Proto{}, WrongCommand(string(tokens[0]))
 }
 
+// publishProto builds PUB command from its payload and trailing options.
+func publishProto(topic, payload []byte, optTokens [][]byte) (Proto, error) {
+	opts, err := parseOptions(optTokens)
+	if err != nil {
+		return Proto{}, err
+	}
+
+	proto := Proto{
+		Command:    string(PUBLISH),
+		Topic:      string(topic),
+		PayloadLen: len(payload),
+		Data:       payload,
+		Options:    opts,
+	}
+
+	if seq, ok := opts["seq"]; ok {
+		if _, err := strconv.ParseUint(seq, 10, 64); err != nil {
+			return Proto{}, fmt.Errorf("proto: wrong sequence number %q: %w", seq, ErrInvalidProto)
+		}
+		proto.Seq = seq
+		delete(opts, "seq")
+	}
+
+	return proto, nil
+}
+
+// readLine returns next non-empty line, skipping line breaks which follow
+// payloads.
+func (p *ProtoReader) readLine() ([]byte, error) {
+	for {
+		line, err := p.reader.ReadLineBytes()
+		if err != nil {
+			return nil, err
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			return line, nil
+		}
+	}
+}
+
+func (p *ProtoReader) readPayload(lenToken []byte) ([]byte, error) {
+	payloadLen, err := strconv.Atoi(string(lenToken))
+	if err != nil || payloadLen < 0 {
+		return nil, fmt.Errorf("proto: wrong payload length %q: %w", lenToken, ErrInvalidProto)
+	}
+
+	payload := make([]byte, payloadLen)
+	if _, err := io.ReadFull(p.reader.R, payload); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+// readHeadersPayload reads header block followed by payload, lengths are
+// header block length and total length of both.
+func (p *ProtoReader) readHeadersPayload(headerLenToken, totalLenToken []byte) (map[string]string, []byte, error) {
+	headerLen, err := strconv.Atoi(string(headerLenToken))
+	if err != nil || headerLen < 0 {
+		return nil, nil, fmt.Errorf("proto: wrong header length %q: %w", headerLenToken, ErrInvalidProto)
+	}
+
+	data, err := p.readPayload(totalLenToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if headerLen > len(data) {
+		return nil, nil, fmt.Errorf("proto: header length %d exceeds total length %d: %w", headerLen, len(data), ErrInvalidProto)
+	}
+
+	headers, err := parseHeaders(data[:headerLen])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return headers, data[headerLen:], nil
+}
+
+// ProtoWriter is safe for concurrent use, frames of a single Write are not
+// interleaved with frames of other writes.
 type ProtoWriter struct {
-	w io.Writer
+	mu sync.Mutex
+	w  io.Writer
 }
 
 func NewProtoWriter(w io.Writer) *ProtoWriter {
 	return &ProtoWriter{w: w}
 }
 
-func (w *ProtoWriter) Write(val Proto) error {
-	data := val.Marshal()
+func (w *ProtoWriter) Write(vals ...Proto) error {
+	var data []byte
+	for _, val := range vals {
+		data = append(data, val.Marshal()...)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
 	_, err := w.w.Write(data)
 	return err
 }
@@ -2,8 +2,12 @@ package server_test
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/vlaner/postal/server"
 )
@@ -99,3 +103,401 @@ func TestWrongTokenAmount(t *testing.T) {
 		})
 	}
 }
+
+func TestConfigOptions(t *testing.T) {
+	msg := &bytes.Buffer{}
+	msg.WriteString("CONFIG topic delivery=roundrobin\r\n")
+
+	proto, err := server.NewProtoReader(msg).Parse()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if proto.Topic != "topic" || proto.Options["delivery"] != "roundrobin" {
+		t.Errorf("got wrong config proto %+v", proto)
+	}
+
+	msg.WriteString("CONFIG topic delivery\r\n")
+	if _, err := server.NewProtoReader(msg).Parse(); err == nil {
+		t.Errorf("expected error for option without value but got nil")
+	}
+}
+
+func TestSubscribeGroup(t *testing.T) {
+	msg := &bytes.Buffer{}
+	msg.WriteString("SUB topic indexer\r\nSUB topic\r\n")
+	reader := server.NewProtoReader(msg)
+
+	proto, err := reader.Parse()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if proto.Topic != "topic" || proto.Group != "indexer" {
+		t.Errorf("got wrong subscribe proto %+v", proto)
+	}
+
+	proto, err = reader.Parse()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if proto.Group != "" {
+		t.Errorf("expected empty group, got %q", proto.Group)
+	}
+}
+
+func TestRedriveAndMessage(t *testing.T) {
+	msg := &bytes.Buffer{}
+	msg.WriteString("REDRIVE topic.$DLQ ids=a,b dryrun=true\r\nMSG topic id 4\r\ndata\r\n")
+	reader := server.NewProtoReader(msg)
+
+	proto, err := reader.Parse()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if proto.Command != "REDRIVE" || proto.Topic != "topic.$DLQ" || proto.Options["ids"] != "a,b" {
+		t.Errorf("got wrong redrive proto %+v", proto)
+	}
+
+	proto, err = reader.Parse()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if proto.Command != "MSG" || proto.MessageID != "id" || string(proto.Data) != "data" {
+		t.Errorf("got wrong message proto %+v", proto)
+	}
+}
+
+func TestNack(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		msg    string
+		delay  time.Duration
+		reason string
+	}{
+		{
+			desc: "only message id",
+			msg:  "NACK id\r\n",
+		},
+		{
+			desc:  "delay",
+			msg:   "NACK id 1500\r\n",
+			delay: 1500 * time.Millisecond,
+		},
+		{
+			desc:   "delay and reason",
+			msg:    "NACK id 10 db is down\r\n",
+			delay:  10 * time.Millisecond,
+			reason: "db is down",
+		},
+		{
+			desc:   "only reason",
+			msg:    "NACK id bad payload\r\n",
+			reason: "bad payload",
+		},
+		{
+			desc:   "reason starting with number",
+			msg:    "NACK id -- 404 not found\r\n",
+			reason: "404 not found",
+		},
+		{
+			desc:   "delay and reason starting with number",
+			msg:    "NACK id 10 -- 404 not found\r\n",
+			delay:  10 * time.Millisecond,
+			reason: "404 not found",
+		},
+		{
+			desc:   "negative number is reason",
+			msg:    "NACK id -5 retries left\r\n",
+			reason: "-5 retries left",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			msg := &bytes.Buffer{}
+			msg.WriteString(tC.msg)
+
+			proto, err := server.NewProtoReader(msg).Parse()
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if proto.Command != "NACK" || proto.MessageID != "id" || proto.Delay != tC.delay || proto.Reason != tC.reason {
+				t.Errorf("got wrong nack proto %+v", proto)
+			}
+		})
+	}
+}
+
+func TestReplies(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		proto server.Proto
+		want  string
+	}{
+		{
+			desc:  "ok without data",
+			proto: server.OKProto(""),
+			want:  "+OK\r\n",
+		},
+		{
+			desc:  "ok with data",
+			proto: server.OKProto("some\ndata"),
+			want:  "+OK some data\r\n",
+		},
+		{
+			desc:  "protocol error",
+			proto: server.ErrorProto(server.WrongTokensNumber(3, 1)),
+			want:  "-ERR PROTO proto: wrong tokens count: expected 3 but got 1: invalid proto data\r\n",
+		},
+		{
+			desc:  "unknown command",
+			proto: server.ErrorProto(server.WrongCommand("TEST")),
+			want:  "-ERR UNKNOWN_COMMAND ",
+		},
+		{
+			desc:  "publish confirm",
+			proto: server.Proto{Command: "+OK", Seq: "7", Data: []byte("805ab639")},
+			want:  "+OK seq=7 805ab639\r\n",
+		},
+		{
+			desc:  "publish error",
+			proto: server.Proto{Command: "-ERR", Seq: "8", Code: server.CodeInvalidPayload, Data: []byte("bad payload")},
+			want:  "-ERR seq=8 INVALID_PAYLOAD bad payload\r\n",
+		},
+		{
+			desc:  "internal error",
+			proto: server.ErrorProto(errors.New("boom")),
+			want:  "-ERR INTERNAL boom\r\n",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			got := string(tC.proto.Marshal())
+			if !strings.HasPrefix(got, tC.want) {
+				t.Errorf("got wrong reply: expected %q got %q", tC.want, got)
+			}
+
+			parsed, err := server.NewProtoReader(strings.NewReader(got)).Parse()
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if parsed.Command != tC.proto.Command || parsed.Code != tC.proto.Code || parsed.Seq != tC.proto.Seq {
+				t.Errorf("got wrong parsed reply %+v", parsed)
+			}
+		})
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	headers := "Content-Type: application/json\r\nCorrelation-Id: 42\r\n\r\n"
+	payload := "{}"
+	msg := fmt.Sprintf("HPUB topic %d %d seq=3\r\n%s%s\r\n", len(headers), len(headers)+len(payload), headers, payload)
+
+	proto, err := server.NewProtoReader(strings.NewReader(msg)).Parse()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if proto.Command != "PUB" || proto.Seq != "3" || string(proto.Data) != payload {
+		t.Errorf("got wrong publish proto %+v", proto)
+	}
+	if proto.Headers["Content-Type"] != "application/json" || proto.Headers["Correlation-Id"] != "42" {
+		t.Errorf("got wrong headers %v", proto.Headers)
+	}
+
+	out := server.Proto{
+		Command:   "HMSG",
+		Topic:     "topic",
+		MessageID: "id",
+		Data:      []byte(payload),
+		Headers:   proto.Headers,
+	}
+	want := fmt.Sprintf("HMSG topic id %d %d\r\n%s%s\r\n", len(headers), len(headers)+len(payload), headers, payload)
+	if got := string(out.Marshal()); got != want {
+		t.Errorf("got wrong message: expected %q got %q", want, got)
+	}
+
+	parsed, err := server.NewProtoReader(strings.NewReader(want)).Parse()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if parsed.MessageID != "id" || string(parsed.Data) != payload || parsed.Headers["Correlation-Id"] != "42" {
+		t.Errorf("got wrong parsed message %+v", parsed)
+	}
+
+	_, err = server.NewProtoReader(strings.NewReader("HPUB topic 10 2\r\n{}\r\n")).Parse()
+	if !errors.Is(err, server.ErrInvalidProto) {
+		t.Errorf("expected invalid proto error for header length over total, got %v", err)
+	}
+}
+
+func TestSubscribeFilter(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		msg    string
+		group  string
+		filter string
+	}{
+		{
+			desc:   "filter",
+			msg:    "SUB orders WHERE amount > 100\r\n",
+			filter: "amount > 100",
+		},
+		{
+			desc:   "group and filter",
+			msg:    "SUB orders billing where region in ('eu', 'us')\r\n",
+			group:  "billing",
+			filter: "region in ('eu', 'us')",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			proto, err := server.NewProtoReader(strings.NewReader(tC.msg)).Parse()
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if proto.Topic != "orders" || proto.Group != tC.group || proto.Filter != tC.filter {
+				t.Errorf("got wrong subscribe proto %+v", proto)
+			}
+		})
+	}
+
+	_, err := server.NewProtoReader(strings.NewReader("SUB orders WHERE\r\n")).Parse()
+	if !errors.Is(err, server.ErrInvalidProto) {
+		t.Errorf("expected invalid proto error for empty filter, got %v", err)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	testCases := []struct {
+		desc  string
+		msg   string
+		want  server.Proto
+		valid bool
+	}{
+		{
+			desc:  "size only",
+			msg:   "FETCH jobs 500\r\n",
+			want:  server.Proto{Command: "FETCH", Topic: "jobs", Max: 500},
+			valid: true,
+		},
+		{
+			desc:  "group and wait",
+			msg:   "FETCH jobs 10 2000 group=workers\r\n",
+			want:  server.Proto{Command: "FETCH", Topic: "jobs", Max: 10, Delay: 2 * time.Second, Group: "workers"},
+			valid: true,
+		},
+		{
+			desc:  "group without wait",
+			msg:   "FETCH jobs 10 group=workers\r\n",
+			want:  server.Proto{Command: "FETCH", Topic: "jobs", Max: 10, Group: "workers"},
+			valid: true,
+		},
+		{
+			desc:  "wait without group",
+			msg:   "FETCH jobs 10 5\r\n",
+			want:  server.Proto{Command: "FETCH", Topic: "jobs", Max: 10, Delay: 5 * time.Millisecond},
+			valid: true,
+		},
+		{
+			desc:  "numeric group",
+			msg:   "FETCH jobs 10 group=2000\r\n",
+			want:  server.Proto{Command: "FETCH", Topic: "jobs", Max: 10, Group: "2000"},
+			valid: true,
+		},
+		{
+			desc: "zero size",
+			msg:  "FETCH jobs 0\r\n",
+		},
+		{
+			desc: "negative wait",
+			msg:  "FETCH jobs 1 -5\r\n",
+		},
+		{
+			desc: "group as positional",
+			msg:  "FETCH jobs 1 workers\r\n",
+		},
+		{
+			desc: "unknown option",
+			msg:  "FETCH jobs 1 wait=5\r\n",
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			proto, err := server.NewProtoReader(strings.NewReader(tC.msg)).Parse()
+			if !tC.valid {
+				if !errors.Is(err, server.ErrInvalidProto) {
+					t.Errorf("expected invalid proto error, got %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(proto, tC.want) {
+				t.Errorf("got wrong fetch proto: expected %+v got %+v", tC.want, proto)
+			}
+		})
+	}
+}
+
+func TestCredit(t *testing.T) {
+	proto, err := server.NewProtoReader(strings.NewReader("SUB jobs workers prefetch=10 WHERE size > 1\r\n")).Parse()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if proto.Group != "workers" || proto.Options["prefetch"] != "10" || proto.Filter != "size > 1" {
+		t.Errorf("got wrong subscribe proto %+v", proto)
+	}
+
+	proto, err = server.NewProtoReader(strings.NewReader("CREDIT jobs 5\r\n")).Parse()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if proto.Command != "CREDIT" || proto.Topic != "jobs" || proto.Max != 5 {
+		t.Errorf("got wrong credit proto %+v", proto)
+	}
+
+	_, err = server.NewProtoReader(strings.NewReader("CREDIT jobs 0\r\n")).Parse()
+	if !errors.Is(err, server.ErrInvalidProto) {
+		t.Errorf("expected invalid proto error for zero credit, got %v", err)
+	}
+}
+
+func TestAckBatch(t *testing.T) {
+	reader := server.NewProtoReader(strings.NewReader("ACK a b c\r\nACK test upto=7\r\nACK upto=7\r\n"))
+
+	proto, err := reader.Parse()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if proto.MessageID != "a" || !reflect.DeepEqual(proto.MessageIDs, []string{"a", "b", "c"}) {
+		t.Errorf("got wrong batch ack proto %+v", proto)
+	}
+
+	proto, err = reader.Parse()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(proto.MessageIDs) != 0 || proto.Topic != "test" || proto.Options["upto"] != "7" {
+		t.Errorf("got wrong cumulative ack proto %+v", proto)
+	}
+
+	if _, err := reader.Parse(); !errors.Is(err, server.ErrInvalidProto) {
+		t.Errorf("expected invalid proto error for cumulative ack without topic, got %v", err)
+	}
+
+	for _, frame := range []server.Proto{
+		{Command: "MSG", Topic: "test", MessageID: "id", PayloadLen: 4, Data: []byte("data"), DeliverySeq: 42},
+		{Command: "HMSG", Topic: "test", MessageID: "id", PayloadLen: 4, Data: []byte("data"), DeliverySeq: 42, Headers: map[string]string{"Trace": "abc"}},
+	} {
+		proto, err := server.NewProtoReader(bytes.NewReader(frame.Marshal())).Parse()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if !reflect.DeepEqual(proto, frame) {
+			t.Errorf("got wrong message frame: expected %+v got %+v", frame, proto)
+		}
+	}
+}
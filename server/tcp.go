@@ -2,31 +2,58 @@ package server
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/vlaner/postal/broker"
+	"github.com/vlaner/postal/filter"
 	"github.com/vlaner/postal/schema"
 )
 
 type Client struct {
 	conn  net.Conn
+	w     *ProtoWriter
 	msgCh chan broker.Message
+	// headers is set once client published with HPUB or subscribed with
+	// headers=true, only such clients get HMSG frames
+	headers *atomic.Bool
 }
 
 type Broker interface {
-	Publish(msg broker.Message)
-	Register(req broker.SubscribeRequest)
+	Publish(msg broker.Message) (string, error)
+	Register(req broker.SubscribeRequest) error
+	Unsubscribe(req broker.SubscribeRequest)
 	Remove(ch chan broker.Message)
-	Ack(msgID string)
+	Ack(ch chan broker.Message, msgID string)
+	AckBatch(req broker.AckRequest)
+	Nack(req broker.NackRequest)
 	SetSchema(topicName string, schema schema.NodeSchema)
+	ConfigureTopic(topicName string, opts map[string]string) error
+	Redrive(req broker.RedriveRequest) ([]broker.Message, error)
+	Fetch(req broker.FetchRequest) ([]broker.Message, error)
+	Credit(req broker.CreditRequest)
+}
+
+type RedriveReport struct {
+	DryRun   bool              `json:"dry_run"`
+	Messages []RedrivenMessage `json:"messages"`
+}
+
+type RedrivenMessage struct {
+	ID       string    `json:"id"`
+	Topic    string    `json:"topic"`
+	SentAt   time.Time `json:"sent_at"`
+	Attempts int       `json:"attempts"`
+	Reason   string    `json:"reason"`
 }
 
 type TCPServer struct {
@@ -106,7 +133,7 @@ func (s *TCPServer) acceptLoop() {
 			tcpConn.SetKeepAlivePeriod(30 * time.Minute)
 
 			s.connWg.Add(1)
-			client := Client{msgCh: make(chan broker.Message, 1), conn: tcpConn}
+			client := Client{msgCh: make(chan broker.Message, 1), conn: tcpConn, w: NewProtoWriter(tcpConn), headers: new(atomic.Bool)}
 			s.clients.Store(tcpConn, client)
 			go s.handleClient(client)
 		}
@@ -123,7 +150,7 @@ func (s *TCPServer) handleClient(client Client) {
 	}()
 
 	r := NewProtoReader(client.conn)
-	w := NewProtoWriter(client.conn)
+	w := client.w
 
 	// TODO: refactor
 	go func() {
@@ -132,7 +159,7 @@ func (s *TCPServer) handleClient(client Client) {
 			case <-s.quit:
 				return
 			case msg := <-client.msgCh:
-				err := w.Write(Proto{MessageID: msg.ID, Command: string(MESSAGE), Topic: msg.Topic, PayloadLen: len(msg.Payload), Data: msg.Payload})
+				err := w.Write(messageProto(msg, client.headers.Load()))
 				if err != nil {
 					var opErr *net.OpError
 					if errors.As(err, &opErr) && !opErr.Temporary() {
@@ -165,51 +192,369 @@ func (s *TCPServer) handleClient(client Client) {
 				}
 
 				log.Println("server: from read connection:", err)
+				if err := w.Write(ErrorProto(err)); err != nil {
+					log.Printf("server: write error to client %v\n", err)
+				}
 				continue
 			}
 
 			log.Printf("server: received message %+v\n", proto)
 
-			switch proto.Command {
-			case string(SUBSCRIBE):
-				s.broker.Register(broker.SubscribeRequest{Topic: proto.Topic, ConsumeCh: client.msgCh})
-			case string(PUBLISH):
-				msgID, err := generateMessageID()
-				if err != nil {
-					log.Printf("server: generate message ID %v\n", err)
-					continue
+			// request is answered once its reply arrives, next commands
+			// do not wait for it
+			if proto.Command == string(REQUEST) {
+				if err := s.request(client, proto); err != nil {
+					writeReply(client, proto, "", err)
 				}
+				continue
+			}
 
-				s.broker.Publish(broker.NewMessage(msgID, proto.Topic, proto.Data))
-			case string(UNSUBSCRIBE):
-				s.broker.Remove(client.msgCh)
-			case string(ACK):
-				s.broker.Ack(proto.MessageID)
-			case string(SCHEMA):
-				p, err := schema.NewParserString(string(proto.Schema))
+			data, err := s.handleCommand(client, proto)
+			writeReply(client, proto, data, err)
+		}
+	}
+}
+
+// writeReply writes success reply to proto with data, or error reply if err
+// is set, right after frames which belong to it.
+func writeReply(client Client, proto Proto, data string, err error, frames ...Proto) {
+	reply := OKProto(data)
+	if err != nil {
+		log.Printf("server: handle %s: %v\n", proto.Command, err)
+		reply = ErrorProto(err)
+	}
+	reply.Seq = proto.Seq
+
+	if err := client.w.Write(append(frames, reply)...); err != nil {
+		log.Printf("server: write reply to client %v\n", err)
+	}
+}
+
+// handleCommand runs client command and returns data for success reply.
+func (s *TCPServer) handleCommand(client Client, proto Proto) (string, error) {
+	switch proto.Command {
+	case string(SUBSCRIBE):
+		if err := broker.ValidateTopic(proto.Topic); err != nil {
+			return "", err
+		}
+
+		sub := broker.SubscribeRequest{Topic: proto.Topic, Group: proto.Group, ConsumeCh: client.msgCh}
+		for key, val := range proto.Options {
+			switch key {
+			case "prefetch":
+				prefetch, err := strconv.Atoi(val)
+				if err != nil || prefetch <= 0 {
+					return "", fmt.Errorf("server: %w: wrong prefetch %q", broker.ErrInvalidOption, val)
+				}
+				sub.Prefetch = prefetch
+			case "from":
+				from, err := broker.ParsePosition(val)
 				if err != nil {
-					log.Println("server: new schema parser: ", err)
-					continue
+					return "", err
 				}
-
-				schem, err := p.Parse()
+				sub.From = from
+			case "headers":
+				enabled, err := strconv.ParseBool(val)
 				if err != nil {
-					log.Println("server:  parse schema: ", err)
-					continue
+					return "", fmt.Errorf("server: %w: wrong headers %q", broker.ErrInvalidOption, val)
+				}
+				if enabled {
+					client.headers.Store(true)
 				}
+			default:
+				return "", fmt.Errorf("server: %w: unknown subscribe option %q", broker.ErrInvalidOption, key)
+			}
+		}
+		if proto.Filter != "" {
+			f, err := filter.Parse(proto.Filter)
+			if err != nil {
+				return "", err
+			}
+			sub.Filter = f
+		}
+
+		if err := s.broker.Register(sub); err != nil {
+			return "", err
+		}
+	case string(PUBLISH):
+		// only HPUB carries headers, its client can read them too
+		if proto.Headers != nil {
+			client.headers.Store(true)
+		}
+
+		msg := broker.NewMessage("", proto.Topic, proto.Data)
+		msg.Headers = proto.Headers
+		if err := applyPublishOptions(&msg, proto); err != nil {
+			return "", err
+		}
+
+		return s.broker.Publish(msg)
+	case string(FETCH):
+		msgs, err := s.broker.Fetch(broker.FetchRequest{
+			Topic:     proto.Topic,
+			Group:     proto.Group,
+			ConsumeCh: client.msgCh,
+			Max:       proto.Max,
+			Wait:      proto.Delay,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		for _, msg := range msgs {
+			if err := client.w.Write(messageProto(msg, client.headers.Load())); err != nil {
+				return "", fmt.Errorf("server: write fetched message: %w", err)
+			}
+		}
+
+		return strconv.Itoa(len(msgs)), nil
+	case string(UNSUBSCRIBE):
+		s.broker.Unsubscribe(broker.SubscribeRequest{Topic: proto.Topic, ConsumeCh: client.msgCh})
+	case string(ACK):
+		req := broker.AckRequest{ConsumeCh: client.msgCh, MessageIDs: proto.MessageIDs, Topic: proto.Topic}
+		for key, val := range proto.Options {
+			if key != "upto" {
+				return "", fmt.Errorf("server: %w: unknown ack option %q", broker.ErrInvalidOption, key)
+			}
 
-				s.broker.SetSchema(proto.Topic, schem)
+			upTo, err := strconv.ParseUint(val, 10, 64)
+			if err != nil || upTo == 0 {
+				return "", fmt.Errorf("server: %w: wrong ack sequence %q", broker.ErrInvalidOption, val)
 			}
+			req.UpTo = upTo
+		}
+
+		s.broker.AckBatch(req)
+	case string(CREDIT):
+		s.broker.Credit(broker.CreditRequest{Topic: proto.Topic, ConsumeCh: client.msgCh, Credit: proto.Max})
+	case string(NACK):
+		s.broker.Nack(broker.NackRequest{
+			ConsumeCh: client.msgCh,
+			MessageID: proto.MessageID,
+			Delay:     proto.Delay,
+			Reason:    proto.Reason,
+		})
+	case string(REDRIVE):
+		req := broker.RedriveRequest{Topic: proto.Topic}
+		if err := req.Apply(proto.Options); err != nil {
+			return "", err
+		}
+
+		msgs, err := s.broker.Redrive(req)
+		if err != nil && len(msgs) > 0 {
+			ids := make([]string, 0, len(msgs))
+			for _, msg := range msgs {
+				ids = append(ids, msg.ID)
+			}
+			return "", fmt.Errorf("%w: moved %s", err, strings.Join(ids, ","))
+		}
+		if err != nil {
+			return "", err
+		}
+
+		report := RedriveReport{DryRun: req.DryRun, Messages: make([]RedrivenMessage, 0, len(msgs))}
+		for _, msg := range msgs {
+			report.Messages = append(report.Messages, RedrivenMessage{
+				ID:       msg.ID,
+				Topic:    msg.OriginTopic,
+				SentAt:   msg.SentAt,
+				Attempts: msg.OriginAttempts,
+				Reason:   msg.Reason,
+			})
+		}
+
+		data, err := json.Marshal(report)
+		if err != nil {
+			return "", fmt.Errorf("marshal redrive report: %w", err)
+		}
+
+		return string(data), nil
+	case string(CONFIG):
+		if err := broker.ValidateTopic(proto.Topic); err != nil {
+			return "", err
+		}
+		if broker.IsWildcard(proto.Topic) {
+			return "", fmt.Errorf("server: %w: can not configure pattern %q", broker.ErrInvalidTopic, proto.Topic)
 		}
+
+		if err := s.broker.ConfigureTopic(proto.Topic, proto.Options); err != nil {
+			return "", err
+		}
+	case string(SCHEMA):
+		if err := broker.ValidateTopic(proto.Topic); err != nil {
+			return "", err
+		}
+
+		p, err := schema.NewParserString(string(proto.Schema))
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+		}
+
+		schem, err := p.Parse()
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+		}
+
+		s.broker.SetSchema(proto.Topic, schem)
+	default:
+		return "", WrongCommand(proto.Command)
 	}
+
+	return "", nil
 }
 
-func generateMessageID() (string, error) {
-	bytes := make([]byte, 16)
-	_, err := rand.Read(bytes)
+// HeaderReplyTo is set on REQ messages to the inbox topic reply should be
+// published to.
+const HeaderReplyTo = "Reply-To"
+
+const defaultRequestTimeout = 5 * time.Second
+
+// request publishes REQ message with a fresh inbox in its Reply-To header
+// and waits for the first reply in the background. Reply is written to
+// client followed by the confirmation with its ID and seq of the request.
+// Request message expires with the timeout so nobody answers it later.
+func (s *TCPServer) request(client Client, proto Proto) error {
+	timeout := defaultRequestTimeout
+	if val, ok := proto.Options["timeout"]; ok {
+		d, err := time.ParseDuration(val)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("server: %w: wrong request timeout %q", broker.ErrInvalidOption, val)
+		}
+		timeout = d
+		delete(proto.Options, "timeout")
+	}
+
+	msg := broker.NewMessage("", proto.Topic, proto.Data)
+	if err := applyPublishOptions(&msg, proto); err != nil {
+		return err
+	}
+	if deadline := msg.SentAt.Add(timeout); msg.ExpiresAt.IsZero() || msg.ExpiresAt.After(deadline) {
+		msg.ExpiresAt = deadline
+	}
+
+	inbox, err := broker.NewInbox()
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	replyCh := make(chan broker.Message, 1)
+	if err := s.broker.Register(broker.SubscribeRequest{Topic: inbox, ConsumeCh: replyCh}); err != nil {
+		return err
+	}
+
+	msg.Headers = map[string]string{HeaderReplyTo: inbox}
+	for key, val := range proto.Headers {
+		msg.Headers[key] = val
+	}
+
+	if _, err := s.broker.Publish(msg); err != nil {
+		s.broker.Remove(replyCh)
+		return err
+	}
+
+	s.connWg.Add(1)
+	go func() {
+		defer s.connWg.Done()
+		defer s.broker.Remove(replyCh)
+
+		select {
+		case reply := <-replyCh:
+			s.broker.Ack(replyCh, reply.ID)
+			writeReply(client, proto, reply.ID, nil, messageProto(reply, client.headers.Load()))
+		case <-time.After(timeout):
+			writeReply(client, proto, "", fmt.Errorf("server: %w: no reply to request on %q within %s", ErrTimeout, proto.Topic, timeout))
+		}
+	}()
+
+	return nil
+}
+
+// Headers added to messages moved out of their origin topic, such as
+// dead-lettered ones.
+const (
+	HeaderOriginTopic = "Postal-Origin-Topic"
+	HeaderAttempts    = "Postal-Attempts"
+	HeaderReason      = "Postal-Reason"
+)
+
+// messageProto is MSG frame of msg, or HMSG if it has headers and client
+// reads them. Clients which do not read headers get MSG without them.
+func messageProto(msg broker.Message, withHeaders bool) Proto {
+	headers := msg.Headers
+	if msg.OriginTopic != "" {
+		headers = make(map[string]string, len(msg.Headers)+3)
+		for key, val := range msg.Headers {
+			headers[key] = val
+		}
+		headers[HeaderOriginTopic] = msg.OriginTopic
+		headers[HeaderAttempts] = strconv.Itoa(msg.OriginAttempts)
+		headers[HeaderReason] = msg.Reason
+	}
+
+	proto := Proto{MessageID: msg.ID, Command: string(MESSAGE), Topic: msg.Topic, PayloadLen: len(msg.Payload), Data: msg.Payload, DeliverySeq: msg.DeliverySeq}
+	if withHeaders && len(headers) > 0 {
+		proto.Command = string(HMESSAGE)
+		proto.Headers = headers
+	}
+
+	return proto
+}
+
+// applyPublishOptions sets message fields from PUB options.
+func applyPublishOptions(msg *broker.Message, proto Proto) error {
+	for key, val := range proto.Options {
+		switch key {
+		case "dedup":
+			msg.DedupKey = val
+		case "producer":
+			// producer sequence numbers are unique per producer, so together
+			// they identify a publish across retries
+			if proto.Seq == "" {
+				return fmt.Errorf("server: %w: producer requires seq", broker.ErrInvalidOption)
+			}
+			if _, ok := proto.Options["dedup"]; ok {
+				return fmt.Errorf("server: %w: producer conflicts with dedup", broker.ErrInvalidOption)
+			}
+			msg.DedupKey = val + "/" + proto.Seq
+		case "delay":
+			if _, ok := proto.Options["at"]; ok {
+				return fmt.Errorf("server: %w: delay conflicts with at", broker.ErrInvalidOption)
+			}
+			d, err := time.ParseDuration(val)
+			if err != nil || d < 0 {
+				return fmt.Errorf("server: %w: wrong delay %q", broker.ErrInvalidOption, val)
+			}
+			msg.NotBefore = msg.SentAt.Add(d)
+		case "ttl":
+			d, err := time.ParseDuration(val)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("server: %w: wrong ttl %q", broker.ErrInvalidOption, val)
+			}
+			msg.ExpiresAt = msg.SentAt.Add(d)
+		case "priority":
+			priority, err := strconv.Atoi(val)
+			if err != nil || priority < 0 || priority > broker.MaxPriority {
+				return fmt.Errorf("server: %w: wrong priority %q: expected 0 to %d", broker.ErrInvalidOption, val, broker.MaxPriority)
+			}
+			msg.Priority = priority
+		case "key":
+			msg.Key = val
+		case "retain":
+			retain, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("server: %w: wrong retain %q", broker.ErrInvalidOption, val)
+			}
+			msg.Retain = retain
+		case "at":
+			at, err := time.Parse(time.RFC3339, val)
+			if err != nil {
+				return fmt.Errorf("server: %w: wrong time %q: expected RFC3339", broker.ErrInvalidOption, val)
+			}
+			msg.NotBefore = at
+		default:
+			return fmt.Errorf("server: %w: unknown publish option %q", broker.ErrInvalidOption, key)
+		}
 	}
 
-	return hex.EncodeToString(bytes), nil
+	return nil
 }
@@ -2,7 +2,10 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
+	"reflect"
 	"testing"
 	"time"
 
@@ -12,11 +15,21 @@ import (
 
 type fakeBroker struct{}
 
-func (b fakeBroker) Publish(broker.Message)              {}
-func (b fakeBroker) Register(broker.SubscribeRequest)    {}
-func (b fakeBroker) Remove(chan broker.Message)          {}
-func (b fakeBroker) Ack(string)                          {}
-func (b fakeBroker) SetSchema(string, schema.NodeSchema) {}
+func (b fakeBroker) Publish(broker.Message) (string, error)         { return "fakeid", nil }
+func (b fakeBroker) Register(broker.SubscribeRequest) error         { return nil }
+func (b fakeBroker) Unsubscribe(broker.SubscribeRequest)            {}
+func (b fakeBroker) Remove(chan broker.Message)                     {}
+func (b fakeBroker) Ack(chan broker.Message, string)                {}
+func (b fakeBroker) AckBatch(broker.AckRequest)                     {}
+func (b fakeBroker) Nack(broker.NackRequest)                        {}
+func (b fakeBroker) SetSchema(string, schema.NodeSchema)            {}
+func (b fakeBroker) ConfigureTopic(string, map[string]string) error { return nil }
+func (b fakeBroker) Redrive(broker.RedriveRequest) ([]broker.Message, error) {
+	return nil, nil
+}
+func (b fakeBroker) Fetch(broker.FetchRequest) ([]broker.Message, error) { return nil, nil }
+func (b fakeBroker) Credit(broker.CreditRequest)                         {}
+
 func TestSimpleServer(t *testing.T) {
 	b := fakeBroker{}
 	port := ":9090"
@@ -52,3 +65,274 @@ func TestSimpleServer(t *testing.T) {
 		t.Errorf("unexpected stop server error: %v", err)
 	}
 }
+
+type rejectingBroker struct {
+	fakeBroker
+}
+
+func (b rejectingBroker) Publish(broker.Message) (string, error) {
+	return "", fmt.Errorf("broker: %w: missing field", broker.ErrInvalidPayload)
+}
+
+func TestServerReplies(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0", rejectingBroker{})
+	if err != nil {
+		t.Fatalf("unexpected new server error: %v", err)
+	}
+	s.Start()
+
+	clientConn, err := net.Dial("tcp", s.ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected dial error: %v", err)
+	}
+
+	_, err = clientConn.Write([]byte("SUB TEST\r\nPUB TEST 2\r\n{}\r\nFOO\r\nSCHEMA TEST 1\r\n]\r\nPUB TEST 2 seq=7\r\n{}\r\nCONFIG TEST.* ttl=1s\r\nCONFIG TEST..A ttl=1s\r\n"))
+	if err != nil {
+		t.Fatalf("unexpected write to server error: %v", err)
+	}
+
+	r := NewProtoReader(clientConn)
+	expected := []struct {
+		command string
+		code    string
+		seq     string
+	}{
+		{command: string(MESSAGE)},
+		{command: string(OK)},
+		{command: string(ERR), code: CodeInvalidPayload},
+		{command: string(ERR), code: CodeUnknownCommand},
+		{command: string(ERR), code: CodeInvalidSchema},
+		{command: string(ERR), code: CodeInvalidPayload, seq: "7"},
+		{command: string(ERR), code: CodeInvalidTopic},
+		{command: string(ERR), code: CodeInvalidTopic},
+	}
+	for _, want := range expected {
+		got, err := r.Parse()
+		if err != nil {
+			t.Fatalf("unexpected read from server error: %v", err)
+		}
+
+		if got.Command != want.command || got.Code != want.code || got.Seq != want.seq {
+			t.Errorf("got wrong reply: expected %s %s seq %q got %+v", want.command, want.code, want.seq, got)
+		}
+	}
+	clientConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.Stop(ctx); err != nil {
+		t.Errorf("unexpected stop server error: %v", err)
+	}
+}
+
+func TestPublishOptions(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		proto   Proto
+		wantKey string
+		wantErr bool
+	}{
+		{
+			desc:    "dedup key",
+			proto:   Proto{Options: map[string]string{"dedup": "order-1"}},
+			wantKey: "order-1",
+		},
+		{
+			desc:    "producer sequence",
+			proto:   Proto{Seq: "7", Options: map[string]string{"producer": "billing"}},
+			wantKey: "billing/7",
+		},
+		{
+			desc:    "producer without sequence",
+			proto:   Proto{Options: map[string]string{"producer": "billing"}},
+			wantErr: true,
+		},
+		{
+			desc:    "unknown option",
+			proto:   Proto{Options: map[string]string{"foo": "bar"}},
+			wantErr: true,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var msg broker.Message
+			err := applyPublishOptions(&msg, tC.proto)
+			if tC.wantErr {
+				if !errors.Is(err, broker.ErrInvalidOption) {
+					t.Errorf("expected invalid option error, got %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if msg.DedupKey != tC.wantKey {
+				t.Errorf("got wrong dedup key: expected %q got %q", tC.wantKey, msg.DedupKey)
+			}
+		})
+	}
+}
+
+func TestMessageProtoHeaders(t *testing.T) {
+	msg := broker.NewMessage("id", "test", []byte("data"))
+	if proto := messageProto(msg, true); proto.Command != string(MESSAGE) {
+		t.Errorf("expected MSG frame for message without headers, got %s", proto.Command)
+	}
+
+	msg.Topic = "test" + broker.DeadLetterSuffix
+	msg.Headers = map[string]string{"Trace": "abc"}
+	msg.OriginTopic = "test"
+	msg.OriginAttempts = 3
+	msg.Reason = "nack"
+
+	if proto := messageProto(msg, false); proto.Command != string(MESSAGE) || proto.Headers != nil {
+		t.Errorf("expected MSG frame for client not reading headers, got %+v", proto)
+	}
+
+	proto := messageProto(msg, true)
+	want := map[string]string{"Trace": "abc", HeaderOriginTopic: "test", HeaderAttempts: "3", HeaderReason: "nack"}
+	if proto.Command != string(HMESSAGE) || !reflect.DeepEqual(proto.Headers, want) {
+		t.Errorf("got wrong dead-lettered message frame %+v", proto)
+	}
+
+	if len(msg.Headers) != 1 {
+		t.Errorf("expected message headers unchanged, got %v", msg.Headers)
+	}
+}
+
+func TestRequestReply(t *testing.T) {
+	b, err := broker.NewBroker()
+	if err != nil {
+		t.Fatalf("unexpected new broker error: %v", err)
+	}
+	go b.Run()
+	defer b.Stop()
+
+	s, err := NewServer("127.0.0.1:0", b)
+	if err != nil {
+		t.Fatalf("unexpected new server error: %v", err)
+	}
+	s.Start()
+
+	dial := func() (net.Conn, *ProtoReader) {
+		conn, err := net.Dial("tcp", s.ln.Addr().String())
+		if err != nil {
+			t.Fatalf("unexpected dial error: %v", err)
+		}
+		r := NewProtoReader(conn)
+		if _, err := r.Parse(); err != nil {
+			t.Fatalf("unexpected read welcome error: %v", err)
+		}
+
+		return conn, r
+	}
+
+	responder, responderR := dial()
+	defer responder.Close()
+	responder.Write([]byte("SUB svc headers=true\r\n"))
+	if got, _ := responderR.Parse(); got.Command != string(OK) {
+		t.Fatalf("got wrong subscribe reply %+v", got)
+	}
+
+	requester, requesterR := dial()
+	defer requester.Close()
+	requester.Write([]byte("REQ svc 4 timeout=5s\r\nping\r\n"))
+
+	req, err := responderR.Parse()
+	if err != nil {
+		t.Fatalf("unexpected read request error: %v", err)
+	}
+	inbox := req.Headers[HeaderReplyTo]
+	if req.Command != string(HMESSAGE) || !broker.IsInbox(inbox) || string(req.Data) != "ping" {
+		t.Fatalf("got wrong request %+v", req)
+	}
+	fmt.Fprintf(responder, "ACK %s\r\nPUB %s 4\r\npong\r\n", req.MessageID, inbox)
+
+	reply, err := requesterR.Parse()
+	if err != nil {
+		t.Fatalf("unexpected read reply error: %v", err)
+	}
+	if reply.Topic != inbox || string(reply.Data) != "pong" {
+		t.Errorf("got wrong reply %+v", reply)
+	}
+	if ok, _ := requesterR.Parse(); ok.Command != string(OK) || string(ok.Data) != reply.MessageID {
+		t.Errorf("got wrong request confirm %+v", ok)
+	}
+
+	// pipelined commands are answered while request waits for its reply
+	requester.Write([]byte("REQ nobody 4 timeout=200ms seq=1\r\nping\r\nPUB other 1 seq=2\r\nx\r\n"))
+	if got, _ := requesterR.Parse(); got.Command != string(OK) || got.Seq != "2" {
+		t.Errorf("expected publish confirmed before request timeout, got %+v", got)
+	}
+	if got, _ := requesterR.Parse(); got.Command != string(ERR) || got.Code != CodeTimeout || got.Seq != "1" {
+		t.Errorf("expected timeout error, got %+v", got)
+	}
+
+	// unanswered request expires instead of reaching a later responder
+	late, lateR := dial()
+	defer late.Close()
+	late.Write([]byte("SUB nobody\r\nPUB nobody 4\r\nlate\r\n"))
+
+	var got Proto
+	for got.Command != string(MESSAGE) {
+		if got, err = lateR.Parse(); err != nil {
+			t.Fatalf("unexpected read error: %v", err)
+		}
+	}
+	if string(got.Data) != "late" {
+		t.Errorf("expected expired request to be dropped, got %+v", got)
+	}
+
+	requester.Close()
+	responder.Close()
+	late.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := s.Stop(ctx); err != nil {
+		t.Errorf("unexpected stop server error: %v", err)
+	}
+}
+
+func TestPublishDelayOptions(t *testing.T) {
+	msg := broker.NewMessage("", "test", nil)
+	if err := applyPublishOptions(&msg, Proto{Options: map[string]string{"delay": "1m"}}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got := msg.NotBefore.Sub(msg.SentAt); got != time.Minute {
+		t.Errorf("got wrong delay: expected 1m got %s", got)
+	}
+
+	at := "2030-01-02T15:04:05Z"
+	if err := applyPublishOptions(&msg, Proto{Options: map[string]string{"at": at}}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got := msg.NotBefore.Format(time.RFC3339); got != at {
+		t.Errorf("got wrong scheduled time: expected %s got %s", at, got)
+	}
+
+	if err := applyPublishOptions(&msg, Proto{Options: map[string]string{"key": "acct-1"}}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if msg.Key != "acct-1" {
+		t.Errorf("got wrong ordering key: expected acct-1 got %q", msg.Key)
+	}
+
+	if err := applyPublishOptions(&msg, Proto{Options: map[string]string{"retain": "true"}}); err != nil || !msg.Retain {
+		t.Errorf("expected retained message, got retain %v error %v", msg.Retain, err)
+	}
+
+	for _, opts := range []map[string]string{
+		{"delay": "-1s"},
+		{"at": "tomorrow"},
+		{"delay": "1s", "at": at},
+		{"retain": "maybe"},
+	} {
+		if err := applyPublishOptions(&msg, Proto{Options: opts}); !errors.Is(err, broker.ErrInvalidOption) {
+			t.Errorf("expected invalid option error for %v, got %v", opts, err)
+		}
+	}
+}